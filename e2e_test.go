@@ -15,12 +15,26 @@ package main
 
 import (
 	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/markushinz/aws-ses-pop3-server/pkg/provider"
@@ -35,9 +49,33 @@ const (
 	verbose = "true"
 )
 
+var implementation = "IMPLEMENTATION aws-ses-pop3-server " + strings.TrimSpace(version)
+
 type setupFunc func(t *testing.T, v *viper.Viper) (teardown func())
 
 func TestE2E(t *testing.T) {
+	s3Mailbox := newFakeS3("bucket", map[string]string{
+		"emails/a": "Subject: first\r\n\r\n.hidden\r\n",
+		"emails/b": "Subject: second\n\nbody\n",
+		"other/c":  "Subject: other\r\n\r\n",
+	})
+	archiveMailbox := newFakeS3("bucket", map[string]string{
+		"inbox/a": "Subject: first\r\n\r\n",
+		"inbox/b": "Subject: second\r\n\r\n",
+	})
+	roleMailbox := newFakeS3("bucket", map[string]string{
+		"jane/a": "Subject: role\r\n\r\n",
+	})
+	roleMailbox.accessKeyID = "ASIAASSUMED"
+	largeMailbox := newFakeS3("bucket", map[string]string{
+		"a": "Subject: first\r\n\r\n",
+		"b": "Subject: second\r\n\r\n",
+	})
+	stsService := &fakeSTS{accessKeyID: "ASIAASSUMED"}
+	maildir := &testMaildir{files: []string{
+		"cur/1700000000.M1P1.host:2,S",
+		"new/1700000100.M2P2.host",
+	}}
 	tests := []struct {
 		name   string
 		config map[string]string
@@ -51,10 +89,10 @@ func TestE2E(t *testing.T) {
 				"password": "password",
 			},
 			run: func(t *testing.T, connection net.Conn) {
-				read(t, connection, "+OK")
+				readGreeting(t, connection)
 
 				write(t, connection, "CAPA")
-				read(t, connection, "+OK", "TOP", "UIDL", "USER", ".")
+				read(t, connection, "+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "SASL PLAIN LOGIN", implementation, ".")
 
 				write(t, connection, "USER user")
 				read(t, connection, "+OK")
@@ -81,6 +119,331 @@ func TestE2E(t *testing.T) {
 				read(t, connection, "+OK")
 			},
 		},
+		{
+			name:   "APOP",
+			setup:  newHtpasswdFile("jane:secret\njohn:tanstaaf\n"),
+			config: map[string]string{},
+			run: func(t *testing.T, connection net.Conn) {
+				timestamp := readGreeting(t, connection)
+				require.NotEmpty(t, timestamp)
+
+				write(t, connection, fmt.Sprintf("APOP john %x", md5.Sum([]byte(timestamp+"invalid"))))
+				read(t, connection, "-ERR [AUTH] invalid credentials")
+
+				write(t, connection, fmt.Sprintf("APOP john %x", md5.Sum([]byte(timestamp+"tanstaaf"))))
+				read(t, connection, "+OK")
+
+				write(t, connection, "STAT")
+				read(t, connection, "+OK 0 0")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+			},
+		},
+		{
+			name:   "htpasswd",
+			setup:  newHtpasswdFile("jane:secret\njohn:tanstaaf\n"),
+			config: map[string]string{},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "USER user")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS changeit")
+				read(t, connection, "-ERR [AUTH] invalid credentials")
+
+				write(t, connection, "USER jane")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS secret")
+				read(t, connection, "+OK")
+			},
+		},
+		{
+			name: "SASL PLAIN",
+			config: map[string]string{
+				"user":     "user",
+				"password": "password",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "AUTH")
+				read(t, connection, "+OK", "PLAIN", "LOGIN", ".")
+
+				write(t, connection, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00user\x00invalid")))
+				read(t, connection, "-ERR [AUTH] invalid credentials")
+
+				write(t, connection, "AUTH PLAIN")
+				read(t, connection, "+ ")
+
+				write(t, connection, base64.StdEncoding.EncodeToString([]byte("\x00user\x00password")))
+				read(t, connection, "+OK")
+
+				write(t, connection, "STAT")
+				read(t, connection, "+OK 0 0")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+			},
+		},
+		{
+			name: "SASL LOGIN",
+			config: map[string]string{
+				"user":            "user",
+				"password":        "password",
+				"sasl-mechanisms": "LOGIN",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "CAPA")
+				read(t, connection, "+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "SASL LOGIN", implementation, ".")
+
+				write(t, connection, "AUTH PLAIN")
+				read(t, connection, "-ERR not supported")
+
+				write(t, connection, "AUTH LOGIN")
+				read(t, connection, "+ VXNlcm5hbWU6")
+
+				write(t, connection, "*")
+				read(t, connection, "-ERR authentication cancelled")
+
+				write(t, connection, "AUTH LOGIN")
+				read(t, connection, "+ VXNlcm5hbWU6")
+
+				write(t, connection, base64.StdEncoding.EncodeToString([]byte("user")))
+				read(t, connection, "+ UGFzc3dvcmQ6")
+
+				write(t, connection, base64.StdEncoding.EncodeToString([]byte("password")))
+				read(t, connection, "+OK")
+
+				write(t, connection, "AUTH LOGIN")
+				read(t, connection, "-ERR command not valid in this state")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+			},
+		},
+		{
+			name:  "S3-compatible endpoint",
+			setup: s3Mailbox.setup,
+			config: map[string]string{
+				"user":                    "user",
+				"password":                "password",
+				"aws-access-key-id":       "minio",
+				"aws-secret-access-key":   "minio123",
+				"aws-s3-region":           "us-east-1",
+				"aws-s3-bucket":           "bucket",
+				"aws-s3-prefix":           "emails",
+				"aws-s3-force-path-style": "true",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "USER user")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS password")
+				read(t, connection, "+OK")
+
+				write(t, connection, "STAT")
+				read(t, connection, "+OK 2 53")
+
+				write(t, connection, "UIDL")
+				read(t, connection, "+OK", "1 a", "2 b", ".")
+
+				write(t, connection, "TOP 1 0")
+				read(t, connection, "+OK", "Subject: first", "", ".")
+
+				write(t, connection, "RETR 1")
+				read(t, connection, "+OK", "Subject: first", "", "..hidden", ".")
+
+				write(t, connection, "LIST 2")
+				read(t, connection, "+OK 2 25")
+
+				write(t, connection, "RETR 2")
+				read(t, connection, "+OK", "Subject: second", "", "body", ".")
+
+				write(t, connection, "DELE 1")
+				read(t, connection, "+OK")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+
+				assert.EqualValues(t, []string{"emails/b", "other/c"}, s3Mailbox.keys())
+			},
+		},
+		{
+			name:  "S3 maildrop too large",
+			setup: largeMailbox.setup,
+			config: map[string]string{
+				"user":                    "user",
+				"password":                "password",
+				"aws-access-key-id":       "minio",
+				"aws-secret-access-key":   "minio123",
+				"aws-s3-region":           "us-east-1",
+				"aws-s3-bucket":           "bucket",
+				"aws-s3-force-path-style": "true",
+				"aws-s3-max-emails":       "1",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "USER user")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS password")
+				read(t, connection, "-ERR [SYS/TEMP] maildrop too large")
+
+				write(t, connection, "STAT")
+				read(t, connection, "-ERR command not valid in this state")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+			},
+		},
+		{
+			name:  "S3 archive instead of delete",
+			setup: archiveMailbox.setup,
+			config: map[string]string{
+				"user":                    "user",
+				"password":                "password",
+				"aws-access-key-id":       "minio",
+				"aws-secret-access-key":   "minio123",
+				"aws-s3-region":           "us-east-1",
+				"aws-s3-bucket":           "bucket",
+				"aws-s3-prefix":           "inbox",
+				"aws-s3-force-path-style": "true",
+				"aws-s3-delete-policy":    "archive",
+				"aws-s3-archive-prefix":   "archive",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "USER user")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS password")
+				read(t, connection, "+OK")
+
+				write(t, connection, "UIDL")
+				read(t, connection, "+OK", "1 a", "2 b", ".")
+
+				write(t, connection, "DELE 1")
+				read(t, connection, "+OK")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+
+				assert.EqualValues(t, []string{"archive/a", "inbox/b"}, archiveMailbox.keys())
+			},
+		},
+		{
+			name: "AssumeRole with default credentials",
+			setup: func(t *testing.T, v *viper.Viper) (teardown func()) {
+				t.Setenv("AWS_ACCESS_KEY_ID", "AKIAENVIRONMENT")
+				t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+				teardownS3 := roleMailbox.setup(t, v)
+				teardownSTS := stsService.setup(t, v)
+				return func() {
+					teardownSTS()
+					teardownS3()
+				}
+			},
+			config: map[string]string{
+				"user":                    "jäne@example.com",
+				"password":                "password",
+				"aws-role-arn":            "arn:aws:iam::123456789012:role/pop3",
+				"aws-external-id":         "external",
+				"aws-s3-region":           "us-east-1",
+				"aws-s3-bucket":           "bucket",
+				"aws-s3-prefix":           "jane",
+				"aws-s3-force-path-style": "true",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "USER jäne@example.com")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS password")
+				read(t, connection, "+OK")
+
+				write(t, connection, "STAT")
+				read(t, connection, "+OK 1 17")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+
+				require.Len(t, stsService.requests, 1)
+				assert.EqualValues(t, "arn:aws:iam::123456789012:role/pop3", stsService.requests[0].Get("RoleArn"))
+				assert.EqualValues(t, "external", stsService.requests[0].Get("ExternalId"))
+				assert.EqualValues(t, "j-ne@example.com", stsService.requests[0].Get("RoleSessionName"))
+				assert.EqualValues(t, []string{"AKIAENVIRONMENT"}, stsService.signers)
+			},
+		},
+		{
+			name:  "Maildir",
+			setup: maildir.setup,
+			config: map[string]string{
+				"user":     "user",
+				"password": "password",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "USER user")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS password")
+				read(t, connection, "+OK")
+
+				write(t, connection, "UIDL")
+				read(t, connection, "+OK", "1 1700000000.M1P1.host", "2 1700000100.M2P2.host", ".")
+
+				write(t, connection, "RETR 2")
+				read(t, connection, "+OK", "Subject: new/1700000100.M2P2.host", "", ".")
+
+				write(t, connection, "DELE 1")
+				read(t, connection, "+OK")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+
+				assert.EqualValues(t, []string{"cur/1700000100.M2P2.host:2,"}, maildir.list(t))
+			},
+		},
+		{
+			name:  "mbox",
+			setup: newMboxFile("From alice@example.com Mon Jan  2 15:04:05 2006\nMessage-ID: <a@example.com>\n\n>From the start\n\n"),
+			config: map[string]string{
+				"user":     "user",
+				"password": "password",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "USER user")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS password")
+				read(t, connection, "+OK")
+
+				write(t, connection, "UIDL")
+				read(t, connection, "+OK", "1 aca56864ecce193226d456d97eaf3144ec432fe0", ".")
+
+				write(t, connection, "RETR 1")
+				read(t, connection, "+OK", "Message-ID: <a@example.com>", "", "From the start", ".")
+
+				write(t, connection, "DELE 1")
+				read(t, connection, "+OK")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+			},
+		},
 		{
 			name: "JWT none",
 			config: map[string]string{
@@ -135,6 +498,11 @@ func TestE2E(t *testing.T) {
 				wants = append(wants, strings.Split(string(*provider.DemoEmail.Payload), "\n")...)
 				wants = append(wants, ".")
 				read(t, connection, wants...)
+				octets := 0
+				for _, want := range wants[1 : len(wants)-1] {
+					octets += len(want) + len("\r\n")
+				}
+				assert.EqualValues(t, provider.DemoEmail.Size, octets)
 
 				write(t, connection, "DELE 1")
 				read(t, connection, "+OK")
@@ -143,6 +511,38 @@ func TestE2E(t *testing.T) {
 				read(t, connection, "+OK")
 			},
 		},
+		{
+			name: "JWT policy",
+			config: map[string]string{
+				"jwt-secret": "secret",
+				"expire":     "never",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				read(t, connection, "+OK")
+
+				write(t, connection, "CAPA")
+				read(t, connection, "+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "EXPIRE NEVER USER", "SASL PLAIN LOGIN OAUTHBEARER XOAUTH2", implementation, ".")
+
+				write(t, connection, "USER policy")
+				read(t, connection, "+OK")
+
+				token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, provider.JWTClaims{
+					Provider: "none",
+					Policy: provider.Policy{
+						LoginDelay: 300,
+					},
+				}).SignedString([]byte("secret"))
+				assert.NoError(t, err)
+				write(t, connection, "PASS "+token)
+				read(t, connection, "+OK")
+
+				write(t, connection, "CAPA")
+				read(t, connection, "+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "EXPIRE NEVER", "LOGIN-DELAY 300", implementation, ".")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+			},
+		},
 		{
 			name: "JWT s3",
 			config: map[string]string{
@@ -162,6 +562,66 @@ func TestE2E(t *testing.T) {
 				read(t, connection, "+OK")
 			},
 		},
+		{
+			name: "JWT OAUTHBEARER",
+			config: map[string]string{
+				"jwt-secret": "secret",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				read(t, connection, "+OK")
+
+				write(t, connection, "CAPA")
+				read(t, connection, "+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "SASL PLAIN LOGIN OAUTHBEARER XOAUTH2", implementation, ".")
+
+				token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, provider.JWTClaims{
+					Provider: "none",
+				}).SignedString([]byte("invalid"))
+				assert.NoError(t, err)
+				write(t, connection, "AUTH OAUTHBEARER "+base64.StdEncoding.EncodeToString([]byte("n,a=jwt,\x01auth=Bearer "+token+"\x01\x01")))
+				read(t, connection, "+ "+base64.StdEncoding.EncodeToString([]byte(`{"status":"invalid_token"}`)))
+
+				write(t, connection, "AQ==")
+				read(t, connection, "-ERR [AUTH] invalid credentials")
+
+				token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, provider.JWTClaims{
+					Provider: "none",
+				}).SignedString([]byte("secret"))
+				assert.NoError(t, err)
+				write(t, connection, "AUTH OAUTHBEARER "+base64.StdEncoding.EncodeToString([]byte("n,a=jwt,\x01auth=Bearer "+token+"\x01\x01")))
+				read(t, connection, "+OK")
+
+				write(t, connection, "STAT")
+				read(t, connection, "+OK 0 0")
+			},
+		},
+		{
+			name: "JWT XOAUTH2",
+			config: map[string]string{
+				"jwt-secret": "secret",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				read(t, connection, "+OK")
+
+				write(t, connection, "AUTH XOAUTH2 "+base64.StdEncoding.EncodeToString([]byte("user=jwt\x01auth=Bearer in.va.lid\x01\x01")))
+				read(t, connection, "+ "+base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer"}`)))
+
+				write(t, connection, "")
+				read(t, connection, "-ERR [AUTH] invalid credentials")
+
+				token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, provider.JWTClaims{
+					Provider: "demo",
+				}).SignedString([]byte("secret"))
+				assert.NoError(t, err)
+				write(t, connection, "AUTH XOAUTH2")
+				read(t, connection, "+ ")
+
+				write(t, connection, base64.StdEncoding.EncodeToString([]byte("user=jwt\x01auth=Bearer "+token+"\x01\x01")))
+				read(t, connection, "+OK")
+
+				write(t, connection, "STAT")
+				read(t, connection, fmt.Sprintf("+OK 1 %v", provider.DemoEmail.Size))
+			},
+		},
 		{
 			name: "JWT unknown provider",
 			config: map[string]string{
@@ -178,10 +638,10 @@ func TestE2E(t *testing.T) {
 				}).SignedString([]byte("secret"))
 				assert.NoError(t, err)
 				write(t, connection, "PASS "+token)
-				read(t, connection, "-ERR")
+				read(t, connection, "-ERR [SYS/PERM] permanent failure, contact your administrator")
 
 				write(t, connection, "STAT")
-				read(t, connection, "-ERR")
+				read(t, connection, "-ERR command not valid in this state")
 			},
 		},
 		{
@@ -200,7 +660,7 @@ func TestE2E(t *testing.T) {
 				}).SignedString([]byte("invalid"))
 				assert.NoError(t, err)
 				write(t, connection, "PASS "+token)
-				read(t, connection, "-ERR")
+				read(t, connection, "-ERR [AUTH] invalid credentials")
 			},
 		},
 		{
@@ -215,7 +675,7 @@ func TestE2E(t *testing.T) {
 				read(t, connection, "+OK")
 
 				write(t, connection, "PASS in.va.lid")
-				read(t, connection, "-ERR")
+				read(t, connection, "-ERR [AUTH] invalid credentials")
 			},
 		},
 		{
@@ -243,7 +703,180 @@ func TestE2E(t *testing.T) {
 				read(t, connection, "+OK")
 
 				write(t, connection, "PASS invalid")
-				read(t, connection, "-ERR")
+				read(t, connection, "-ERR [AUTH] invalid credentials")
+			},
+		},
+		{
+			name:  "STLS",
+			setup: newTLSCertificate,
+			config: map[string]string{
+				"user":                   "user",
+				"password":               "password",
+				"stls":                   "true",
+				"disable-plaintext-auth": "true",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "CAPA")
+				read(t, connection, "+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "STLS", implementation, ".")
+
+				write(t, connection, "USER user")
+				read(t, connection, "-ERR plaintext authentication disabled")
+
+				write(t, connection, "STLS")
+				read(t, connection, "+OK")
+
+				tlsConnection := tls.Client(connection, &tls.Config{InsecureSkipVerify: true})
+				require.NoError(t, tlsConnection.Handshake())
+				connection = newBufferedConn(tlsConnection)
+
+				write(t, connection, "CAPA")
+				read(t, connection, "+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "SASL PLAIN LOGIN", implementation, ".")
+
+				write(t, connection, "STLS")
+				read(t, connection, "-ERR command not valid in this state")
+
+				write(t, connection, "USER user")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS password")
+				read(t, connection, "+OK")
+
+				write(t, connection, "QUIT")
+				read(t, connection, "+OK")
+			},
+		},
+		{
+			name: "STLS unavailable",
+			config: map[string]string{
+				"user":     "user",
+				"password": "password",
+				"stls":     "true",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "STLS")
+				read(t, connection, "-ERR command not valid in this state")
+
+				write(t, connection, "USER user")
+				read(t, connection, "+OK")
+
+				write(t, connection, "PASS password")
+				read(t, connection, "+OK")
+			},
+		},
+		{
+			name: "pipelining",
+			config: map[string]string{
+				"jwt-secret": "secret",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				read(t, connection, "+OK")
+
+				token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, provider.JWTClaims{
+					Provider: "demo",
+				}).SignedString([]byte("secret"))
+				assert.NoError(t, err)
+				write(t, connection, strings.Join([]string{
+					"CAPA",
+					"USER jwt",
+					"PASS " + token,
+					"STAT",
+					"UIDL",
+					"RETR 1",
+					"DELE 1",
+					"LIST",
+					"RSET",
+					"LIST 1",
+					"QUIT",
+				}, "\r\n"))
+
+				read(t, connection, "+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "SASL PLAIN LOGIN OAUTHBEARER XOAUTH2", implementation, ".")
+				read(t, connection, "+OK")
+				read(t, connection, "+OK")
+				read(t, connection, fmt.Sprintf("+OK 1 %v", provider.DemoEmail.Size))
+				read(t, connection, "+OK", "1 "+provider.DemoEmail.ID, ".")
+				wants := []string{"+OK"}
+				wants = append(wants, strings.Split(string(*provider.DemoEmail.Payload), "\n")...)
+				wants = append(wants, ".")
+				read(t, connection, wants...)
+				read(t, connection, "+OK")
+				read(t, connection, "+OK", ".")
+				read(t, connection, "+OK")
+				read(t, connection, fmt.Sprintf("+OK 1 %v", provider.DemoEmail.Size))
+				read(t, connection, "+OK")
+			},
+		},
+		{
+			name: "pipelining many commands",
+			config: map[string]string{
+				"user":     "user",
+				"password": "password",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				commands := []string{"USER user", "PASS password"}
+				for i := 0; i < 1000; i++ {
+					commands = append(commands, "NOOP", "STAT", "FOO")
+				}
+				commands = append(commands, "QUIT")
+				write(t, connection, strings.Join(commands, "\r\n"))
+
+				read(t, connection, "+OK", "+OK")
+				for i := 0; i < 1000; i++ {
+					read(t, connection, "+OK", "+OK 0 0", "-ERR unknown command")
+				}
+				read(t, connection, "+OK")
+			},
+		},
+		{
+			name: "preauth timeout",
+			config: map[string]string{
+				"user":               "user",
+				"password":           "password",
+				"preauth-timeout":    "200ms",
+				"autologout-timeout": "10m",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				readGreeting(t, connection)
+
+				write(t, connection, "USER user")
+				read(t, connection, "+OK")
+
+				time.Sleep(400 * time.Millisecond)
+				readEOF(t, connection)
+			},
+		},
+		{
+			name: "autologout",
+			config: map[string]string{
+				"jwt-secret":         "secret",
+				"preauth-timeout":    "10m",
+				"autologout-timeout": "200ms",
+			},
+			run: func(t *testing.T, connection net.Conn) {
+				read(t, connection, "+OK")
+
+				token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, provider.JWTClaims{
+					Provider: "demo",
+				}).SignedString([]byte("secret"))
+				assert.NoError(t, err)
+				write(t, connection, "USER jwt")
+				read(t, connection, "+OK")
+				write(t, connection, "PASS "+token)
+				read(t, connection, "+OK")
+
+				write(t, connection, "NOOP")
+				read(t, connection, "+OK")
+				time.Sleep(100 * time.Millisecond)
+				write(t, connection, "DELE 1")
+				read(t, connection, "+OK")
+
+				time.Sleep(400 * time.Millisecond)
+				readEOF(t, connection)
 			},
 		},
 	}
@@ -263,8 +896,8 @@ func TestE2E(t *testing.T) {
 				teardown := tt.setup(t, v)
 				defer teardown()
 			}
-			providerCreator := initProviderCreator(v)
-			handlerCreator := initHandlerCreator(v, providerCreator)
+			providerCreator, apopProviderCreator := initProviderCreator(v)
+			handlerCreator := initHandlerCreator(v, providerCreator, apopProviderCreator)
 			serverCreator := initServerCreator(v, handlerCreator)
 			server := serverCreator()
 			go server.Listen()
@@ -273,21 +906,59 @@ func TestE2E(t *testing.T) {
 			}()
 			connection, err := net.Dial("tcp", host+":"+port)
 			require.NoError(t, err)
-			tt.run(t, connection)
+			tt.run(t, newBufferedConn(connection))
 		})
 	}
 }
 
+// bufferedConn keeps a single reader per connection so that responses to pipelined commands are not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newBufferedConn(connection net.Conn) *bufferedConn {
+	return &bufferedConn{
+		Conn:   connection,
+		reader: bufio.NewReader(connection),
+	}
+}
+
+func (connection *bufferedConn) Read(b []byte) (n int, err error) {
+	return connection.reader.Read(b)
+}
+
+func readLine(t *testing.T, connection net.Conn) string {
+	bufferedConnection, ok := connection.(*bufferedConn)
+	require.True(t, ok, "connection must be a *bufferedConn")
+	bytes, err := bufferedConnection.reader.ReadBytes('\n')
+	require.NoError(t, err)
+	return strings.TrimRight(string(bytes), "\r\n")
+}
+
 func read(t *testing.T, connection net.Conn, wants ...string) {
-	reader := bufio.NewReader(connection)
 	for _, want := range wants {
-		bytes, err := reader.ReadBytes('\n')
-		require.NoError(t, err)
-		got := strings.TrimRight(string(bytes), "\r\n")
-		require.Equal(t, want, got)
+		require.Equal(t, want, readLine(t, connection))
 	}
 }
 
+// readEOF expects the server to close the connection without sending any response.
+func readEOF(t *testing.T, connection net.Conn) {
+	bufferedConnection, ok := connection.(*bufferedConn)
+	require.True(t, ok, "connection must be a *bufferedConn")
+	_, err := bufferedConnection.reader.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func readGreeting(t *testing.T, connection net.Conn) (timestamp string) {
+	got := readLine(t, connection)
+	require.True(t, strings.HasPrefix(got, "+OK"), got)
+	if start := strings.Index(got, "<"); start >= 0 {
+		return got[start:]
+	}
+	return ""
+}
+
 func write(t *testing.T, connection net.Conn, data string) {
 	_, err := connection.Write([]byte(data + "\r\n"))
 	require.NoError(t, err)
@@ -310,3 +981,102 @@ func newHttpBasicAuthServer(user, password string) setupFunc {
 		}
 	}
 }
+
+func newHtpasswdFile(content string) setupFunc {
+	return func(t *testing.T, v *viper.Viper) (teardown func()) {
+		path := filepath.Join(t.TempDir(), "htpasswd")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		v.Set("htpasswd-path", path)
+		return func() {}
+	}
+}
+
+func newMboxFile(content string) setupFunc {
+	return func(t *testing.T, v *viper.Viper) (teardown func()) {
+		path := filepath.Join(t.TempDir(), "mbox")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		v.Set("mbox-path", path)
+		return func() {
+			data, err := os.ReadFile(path)
+			assert.NoError(t, err)
+			assert.Empty(t, data)
+		}
+	}
+}
+
+// testMaildir is a Maildir containing files whose modification times increase in the given order.
+type testMaildir struct {
+	files []string
+	path  string
+}
+
+func (maildir *testMaildir) setup(t *testing.T, v *viper.Viper) (teardown func()) {
+	maildir.path = t.TempDir()
+	for _, dir := range []string{"cur", "new", "tmp"} {
+		require.NoError(t, os.Mkdir(filepath.Join(maildir.path, dir), 0700))
+	}
+	modTime := time.Now().Add(-time.Hour)
+	for index, file := range maildir.files {
+		path := filepath.Join(maildir.path, file)
+		require.NoError(t, os.WriteFile(path, []byte("Subject: "+file+"\n\n"), 0600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime.Add(time.Duration(index)*time.Minute)))
+	}
+	v.Set("maildir-path", maildir.path)
+	return func() {}
+}
+
+func (maildir *testMaildir) list(t *testing.T) (files []string) {
+	for _, dir := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(maildir.path, dir))
+		require.NoError(t, err)
+		for _, entry := range entries {
+			files = append(files, dir+"/"+entry.Name())
+		}
+	}
+	return files
+}
+
+func newTLSCertificate(t *testing.T, v *viper.Viper) (teardown func()) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	privateKey, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	v.Set("tls-cert", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})))
+	v.Set("tls-key", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKey})))
+	return func() {}
+}
+
+func TestGetDuration(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		value interface{}
+		want  time.Duration
+	}{
+		{name: "default", value: time.Minute, want: time.Minute},
+		{name: "number", value: 300, want: 300 * time.Second},
+		{name: "environment", value: "300", want: 300 * time.Second},
+		{name: "fraction", value: "0.5", want: 500 * time.Millisecond},
+		{name: "unit", value: "5m", want: 5 * time.Minute},
+		{name: "zero", value: "0", want: 0},
+		{name: "autologout", value: 600, want: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			v := viper.New()
+			v.Set("duration", tt.value)
+			assert.EqualValues(t, tt.want, getDuration(v, "duration"))
+		})
+	}
+}
@@ -0,0 +1,356 @@
+/*
+   Copyright 2022 Markus Hinz
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+     http://www.apache.org/licenses/LICENSE-2.0
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// fakeS3 is an in-process stand-in for an S3-compatible service that supports the requests issued
+// by the S3 provider using path-style addressing: ListObjectsV2, GetObject (with Range), CopyObject within
+// the bucket, GetObjectTagging, PutObjectTagging and DeleteObjects.
+type fakeS3 struct {
+	sync.Mutex
+	bucket  string
+	objects map[string]fakeObject
+	// accessKeyID is required in the signature of every request if set.
+	accessKeyID string
+}
+
+type fakeObject struct {
+	content      []byte
+	lastModified time.Time
+	tags         []fakeTag
+}
+
+type fakeTag struct {
+	Key   string
+	Value string
+}
+
+func newFakeS3(bucket string, objects map[string]string) *fakeS3 {
+	fake := &fakeS3{
+		bucket:  bucket,
+		objects: make(map[string]fakeObject),
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for key, content := range objects {
+		fake.objects[key] = fakeObject{content: []byte(content), lastModified: now}
+	}
+	return fake
+}
+
+func (fake *fakeS3) keys() []string {
+	fake.Lock()
+	defer fake.Unlock()
+	var keys []string
+	for key := range fake.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setup starts the fake with a self-signed certificate that is passed as aws-s3-ca-bundle.
+func (fake *fakeS3) setup(t *testing.T, v *viper.Viper) (teardown func()) {
+	server := httptest.NewTLSServer(fake)
+	v.Set("aws-s3-endpoint", server.URL)
+	v.Set("aws-s3-ca-bundle", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+	return func() {
+		server.Close()
+	}
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fake.Lock()
+	defer fake.Unlock()
+	if fake.accessKeyID != "" && !strings.Contains(req.Header.Get("Authorization"), "Credential="+fake.accessKeyID+"/") {
+		fake.writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if bucket != fake.bucket {
+		fake.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	switch {
+	case req.Method == http.MethodGet && key == "" && req.URL.Query().Get("list-type") == "2":
+		fake.listObjectsV2(w, req)
+	case req.Method == http.MethodGet && key != "" && req.URL.Query().Has("tagging"):
+		fake.getObjectTagging(w, key)
+	case req.Method == http.MethodPut && key != "" && req.URL.Query().Has("tagging"):
+		fake.putObjectTagging(w, req, key)
+	case req.Method == http.MethodGet && key != "":
+		fake.getObject(w, req, key)
+	case req.Method == http.MethodPut && key != "" && req.Header.Get("X-Amz-Copy-Source") != "":
+		fake.copyObject(w, req, key)
+	case req.Method == http.MethodPost && key == "" && req.URL.Query().Has("delete"):
+		fake.deleteObjects(w, req)
+	default:
+		fake.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (fake *fakeS3) listObjectsV2(w http.ResponseWriter, req *http.Request) {
+	type object struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []object
+	}{
+		Name:   fake.bucket,
+		Prefix: req.URL.Query().Get("prefix"),
+	}
+	for key, fakeObject := range fake.objects {
+		if !strings.HasPrefix(key, result.Prefix) {
+			continue
+		}
+		result.Contents = append(result.Contents, object{
+			Key:          key,
+			LastModified: fakeObject.lastModified.Format(time.RFC3339),
+			ETag:         etag(fakeObject.content),
+			Size:         len(fakeObject.content),
+		})
+	}
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	result.KeyCount = len(result.Contents)
+	writeXML(w, http.StatusOK, result)
+}
+
+func (fake *fakeS3) getObject(w http.ResponseWriter, req *http.Request, key string) {
+	object, exists := fake.objects[key]
+	if !exists {
+		fake.writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", etag(object.content))
+	content := object.content
+	status := http.StatusOK
+	if byteRange := req.Header.Get("Range"); byteRange != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(byteRange, "bytes=%d-%d", &start, &end); err != nil || start >= len(content) {
+			fake.writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		if end >= len(content) {
+			end = len(content) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end, len(content)))
+		content = content[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+func (fake *fakeS3) getObjectTagging(w http.ResponseWriter, key string) {
+	object, exists := fake.objects[key]
+	if !exists {
+		fake.writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name  `xml:"Tagging"`
+		TagSet  []fakeTag `xml:"TagSet>Tag"`
+	}{
+		TagSet: object.tags,
+	})
+}
+
+func (fake *fakeS3) putObjectTagging(w http.ResponseWriter, req *http.Request, key string) {
+	object, exists := fake.objects[key]
+	if !exists {
+		fake.writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	var input struct {
+		TagSet []fakeTag `xml:"TagSet>Tag"`
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil || xml.Unmarshal(body, &input) != nil {
+		fake.writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	object.tags = input.TagSet
+	fake.objects[key] = object
+	w.WriteHeader(http.StatusOK)
+}
+
+func (fake *fakeS3) copyObject(w http.ResponseWriter, req *http.Request, key string) {
+	source, err := url.PathUnescape(req.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		fake.writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	bucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	object, exists := fake.objects[sourceKey]
+	if bucket != fake.bucket || !exists {
+		fake.writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	fake.objects[key] = object
+	writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		LastModified string
+		ETag         string
+	}{
+		LastModified: object.lastModified.Format(time.RFC3339),
+		ETag:         etag(object.content),
+	})
+}
+
+func (fake *fakeS3) deleteObjects(w http.ResponseWriter, req *http.Request) {
+	var input struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil || xml.Unmarshal(body, &input) != nil {
+		fake.writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	type deleted struct {
+		Key string
+	}
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Deleted []deleted `xml:"Deleted"`
+	}{}
+	for _, object := range input.Objects {
+		delete(fake.objects, object.Key)
+		result.Deleted = append(result.Deleted, deleted{Key: object.Key})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (fake *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	writeXML(w, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{
+		Code:    code,
+		Message: code,
+	})
+}
+
+// fakeSTS is an in-process stand-in for STS that grants every AssumeRole request the same credentials.
+type fakeSTS struct {
+	sync.Mutex
+	accessKeyID string
+	// requests records the form values of all AssumeRole requests.
+	requests []url.Values
+	// signers records the access key IDs that signed the requests.
+	signers []string
+}
+
+func (fake *fakeSTS) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fake.Lock()
+	defer fake.Unlock()
+	if err := req.ParseForm(); err != nil || req.PostForm.Get("Action") != "AssumeRole" {
+		writeXML(w, http.StatusBadRequest, struct {
+			XMLName xml.Name `xml:"ErrorResponse"`
+			Error   struct {
+				Code    string
+				Message string
+			}
+		}{})
+		return
+	}
+	fake.requests = append(fake.requests, req.PostForm)
+	_, credential, _ := strings.Cut(req.Header.Get("Authorization"), "Credential=")
+	signer, _, _ := strings.Cut(credential, "/")
+	fake.signers = append(fake.signers, signer)
+	type credentials struct {
+		AccessKeyId     string
+		SecretAccessKey string
+		SessionToken    string
+		Expiration      string
+	}
+	type assumedRoleUser struct {
+		Arn           string
+		AssumedRoleId string
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName          xml.Name `xml:"AssumeRoleResponse"`
+		AssumeRoleResult struct {
+			Credentials     credentials
+			AssumedRoleUser assumedRoleUser
+		}
+	}{
+		AssumeRoleResult: struct {
+			Credentials     credentials
+			AssumedRoleUser assumedRoleUser
+		}{
+			Credentials: credentials{
+				AccessKeyId:     fake.accessKeyID,
+				SecretAccessKey: "secret",
+				SessionToken:    "token",
+				Expiration:      time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			},
+			AssumedRoleUser: assumedRoleUser{
+				Arn:           req.PostForm.Get("RoleArn") + "/" + req.PostForm.Get("RoleSessionName"),
+				AssumedRoleId: "AROA:" + req.PostForm.Get("RoleSessionName"),
+			},
+		},
+	})
+}
+
+// setup starts the fake and configures it as aws-sts-endpoint. As httptest uses the same certificate
+// for all TLS servers, it has to be called after fakeS3.setup that configures the CA bundle.
+func (fake *fakeSTS) setup(t *testing.T, v *viper.Viper) (teardown func()) {
+	server := httptest.NewTLSServer(fake)
+	v.Set("aws-sts-endpoint", server.URL)
+	return func() {
+		server.Close()
+	}
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func etag(content []byte) string {
+	sum := md5.Sum(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
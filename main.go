@@ -18,9 +18,12 @@ package main
 
 import (
 	"crypto/tls"
+	_ "embed"
 	"fmt"
 	"log"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -30,6 +33,9 @@ import (
 	"github.com/spf13/viper"
 )
 
+//go:embed version.txt
+var version string
+
 func main() {
 	v := viper.New()
 	v.SetEnvPrefix("POP3")
@@ -45,18 +51,18 @@ func main() {
 			log.Fatal(fmt.Sprintf("Fatal error loadConfig(): %v", err))
 		}
 	}
-	providerCreator := initProviderCreator(v)
-	handlerCreator := initHandlerCreator(v, providerCreator)
+	providerCreator, apopProviderCreator := initProviderCreator(v)
+	handlerCreator := initHandlerCreator(v, providerCreator, apopProviderCreator)
 	serverCreator := initServerCreator(v, handlerCreator)
 	server := serverCreator()
 	server.Listen()
 }
 
-func initProviderCreator(v *viper.Viper) provider.ProviderCreator {
+func initProviderCreator(v *viper.Viper) (provider.ProviderCreator, provider.APOPProviderCreator) {
 	if v.IsSet("jwt-secret") {
 		return provider.NewJWTProviderCreator(
 			v.GetString("jwt-secret"),
-		)
+		), nil
 	}
 
 	if v.IsSet("http-basic-auth-url") {
@@ -78,23 +84,54 @@ func initProviderCreator(v *viper.Viper) provider.ProviderCreator {
 		return provider.NewHTTPBasicAuthProviderCreator(
 			10*time.Second,
 			rawURL,
-		)
+		), nil
 	}
 
-	if !v.IsSet("user") {
-		log.Print("Warning: No user specified. \"user\" will be used")
-	}
-	v.SetDefault("user", "user")
-	if !v.IsSet("password") {
-		log.Print("Warning: No password specified. \"changeit\" will be used. DO NOT USE IN PRODUCTION!")
-	}
-	v.SetDefault("password", "changeit")
-	staticCreds := provider.StaticCredentials{
-		User:     v.GetString("user"),
-		Password: v.GetString("password"),
+	staticCreds := provider.StaticCredentials{}
+	if v.IsSet("htpasswd-path") {
+		users, err := provider.ReadHtpasswdFile(v.GetString("htpasswd-path"))
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Fatal error initProviderCreator(): %v", err))
+		}
+		staticCreds.Users = users
+	} else {
+		if !v.IsSet("user") {
+			log.Print("Warning: No user specified. \"user\" will be used")
+		}
+		v.SetDefault("user", "user")
+		if !v.IsSet("password") {
+			log.Print("Warning: No password specified. \"changeit\" will be used. DO NOT USE IN PRODUCTION!")
+		}
+		v.SetDefault("password", "changeit")
 	}
-	if v.IsSet("aws-access-key-id") && v.IsSet("aws-secret-access-key") {
+	staticCreds.User = v.GetString("user")
+	staticCreds.Password = v.GetString("password")
+	// Without aws-access-key-id and aws-secret-access-key, the default credential chain of the AWS SDK is used.
+	if (v.IsSet("aws-access-key-id") && v.IsSet("aws-secret-access-key")) || v.IsSet("aws-s3-bucket") {
+		v.SetDefault("aws-access-key-id", "")
+		v.SetDefault("aws-secret-access-key", "")
+		v.SetDefault("aws-role-arn", "")
+		v.SetDefault("aws-external-id", "")
+		v.SetDefault("aws-sts-endpoint", "")
 		v.SetDefault("aws-s3-prefix", "")
+		v.SetDefault("aws-s3-max-emails", 0)
+		v.SetDefault("aws-s3-order", provider.OrderKey)
+		v.SetDefault("aws-s3-endpoint", "")
+		v.SetDefault("aws-s3-force-path-style", false)
+		v.SetDefault("aws-s3-disable-ssl", false)
+		v.SetDefault("aws-s3-delete-policy", provider.DeletePolicyDelete)
+		v.SetDefault("aws-s3-archive-bucket", "")
+		v.SetDefault("aws-s3-archive-prefix", "")
+		v.SetDefault("aws-s3-archive-storage-class", "")
+		v.SetDefault("aws-s3-wire-size-tags", false)
+		caBundle := v.GetString("aws-s3-ca-bundle")
+		if caBundle == "" && v.IsSet("aws-s3-ca-bundle-path") {
+			content, err := os.ReadFile(v.GetString("aws-s3-ca-bundle-path"))
+			if err != nil {
+				log.Fatal(fmt.Sprintf("Fatal error initProviderCreator(): %v", err))
+			}
+			caBundle = string(content)
+		}
 		v.SetDefault("aws-session-token", "")
 		if !v.IsSet("aws-s3-region") {
 			log.Fatal("Fatal error initProviderCreator(): No aws-s3-region specified")
@@ -103,23 +140,80 @@ func initProviderCreator(v *viper.Viper) provider.ProviderCreator {
 			log.Fatal("Fatal error initProviderCreator(): No aws-s3-bucket specified")
 		}
 		staticCreds.S3Bucket = &provider.S3Bucket{
-			AWSAccessKeyID:     v.GetString("aws-access-key-id"),
-			AWSSecretAccessKey: v.GetString("aws-secret-access-key"),
-			AWSSessionToken:    v.GetString("aws-session-token"),
-			Region:             v.GetString("aws-s3-region"),
-			Bucket:             v.GetString("aws-s3-bucket"),
-			Prefix:             v.GetString("aws-s3-prefix"),
+			AWSAccessKeyID:      v.GetString("aws-access-key-id"),
+			AWSSecretAccessKey:  v.GetString("aws-secret-access-key"),
+			AWSSessionToken:     v.GetString("aws-session-token"),
+			Region:              v.GetString("aws-s3-region"),
+			Bucket:              v.GetString("aws-s3-bucket"),
+			Prefix:              v.GetString("aws-s3-prefix"),
+			MaxEmails:           v.GetInt("aws-s3-max-emails"),
+			Order:               v.GetString("aws-s3-order"),
+			Endpoint:            v.GetString("aws-s3-endpoint"),
+			ForcePathStyle:      v.GetBool("aws-s3-force-path-style"),
+			CABundle:            caBundle,
+			DisableSSL:          v.GetBool("aws-s3-disable-ssl"),
+			RoleARN:             v.GetString("aws-role-arn"),
+			ExternalID:          v.GetString("aws-external-id"),
+			STSEndpoint:         v.GetString("aws-sts-endpoint"),
+			DeletePolicy:        v.GetString("aws-s3-delete-policy"),
+			ArchiveBucket:       v.GetString("aws-s3-archive-bucket"),
+			ArchivePrefix:       v.GetString("aws-s3-archive-prefix"),
+			ArchiveStorageClass: v.GetString("aws-s3-archive-storage-class"),
+			WireSizeTags:        v.GetBool("aws-s3-wire-size-tags"),
 		}
+	} else if v.IsSet("maildir-path") {
+		staticCreds.Maildir = v.GetString("maildir-path")
+	} else if v.IsSet("mbox-path") {
+		staticCreds.Mbox = v.GetString("mbox-path")
 	}
 
-	return provider.NewStaticCredentialsProviderCreator(staticCreds)
+	return provider.NewStaticCredentialsProviderCreator(staticCreds),
+		provider.NewStaticCredentialsAPOPProviderCreator(staticCreds)
 }
 
-func initHandlerCreator(v *viper.Viper, providerCreator provider.ProviderCreator) handler.HandlerCreator {
+func initHandlerCreator(v *viper.Viper, providerCreator provider.ProviderCreator, apopProviderCreator provider.APOPProviderCreator) handler.HandlerCreator {
 	v.SetDefault("verbose", false)
+	v.SetDefault("disable-plaintext-auth", false)
+	if v.IsSet("jwt-secret") {
+		v.SetDefault("sasl-mechanisms", []string{"PLAIN", "LOGIN", "OAUTHBEARER", "XOAUTH2"})
+	} else {
+		v.SetDefault("sasl-mechanisms", []string{"PLAIN", "LOGIN"})
+	}
+	v.SetDefault("preauth-timeout", time.Minute)
+	v.SetDefault("autologout-timeout", 10*time.Minute)
+	v.SetDefault("write-timeout", time.Minute)
+	v.SetDefault("utf8-downgrade", false)
+	if timeout := getDuration(v, "autologout-timeout"); timeout > 0 && timeout < 10*time.Minute {
+		log.Print("Warning: autologout-timeout is less than 10 minutes as required by RFC 1939. Clients may be logged out unexpectedly.")
+	}
+	v.SetDefault("expire", "")
+	v.SetDefault("login-delay", 0)
+	loginDelay := getDuration(v, "login-delay")
+	if loginDelay > 0 && loginDelay < time.Second {
+		log.Fatal("Fatal error initHandlerCreator(): login-delay must be at least one second")
+	}
+	policy := provider.Policy{
+		Expire:     strings.ToUpper(v.GetString("expire")),
+		LoginDelay: int(loginDelay.Seconds()),
+	}
+	if err := policy.Validate(); err != nil {
+		log.Fatal(fmt.Sprintf("Fatal error initHandlerCreator(): %v", err))
+	}
 	return handler.NewPOP3HandlerCreator(
 		providerCreator,
-		v.GetBool("verbose"),
+		handler.POP3Options{
+			Verbose:              v.GetBool("verbose"),
+			DisablePlaintextAuth: v.GetBool("disable-plaintext-auth"),
+			SASLMechanisms:       v.GetStringSlice("sasl-mechanisms"),
+			APOPProviderCreator:  apopProviderCreator,
+			PreAuthTimeout:       getDuration(v, "preauth-timeout"),
+			AutologoutTimeout:    getDuration(v, "autologout-timeout"),
+			WriteTimeout:         getDuration(v, "write-timeout"),
+			DowngradeHeaders:     v.GetBool("utf8-downgrade"),
+			Policy:               policy,
+			PolicyPerUser:        v.IsSet("jwt-secret") || v.IsSet("http-basic-auth-url"),
+			Implementation:       "aws-ses-pop3-server " + strings.TrimSpace(version),
+		},
 	)
 }
 
@@ -147,6 +241,14 @@ func initServerCreator(v *viper.Viper, handlerCreator handler.HandlerCreator) se
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Fatal error loadServerCreator(): %v", err))
 	}
+	if v.GetBool("stls") {
+		v.SetDefault("port", 2110)
+		return server.NewTCPSTLSServerCreator(handlerCreator,
+			v.GetString("host"),
+			v.GetInt("port"),
+			certificate,
+		)
+	}
 	v.SetDefault("port", 2995)
 	return server.NewTCPTLSServerCreator(handlerCreator,
 		v.GetString("host"),
@@ -154,3 +256,12 @@ func initServerCreator(v *viper.Viper, handlerCreator handler.HandlerCreator) se
 		certificate,
 	)
 }
+
+// getDuration returns the duration of key. Unlike v.GetDuration, numbers without unit are seconds,
+// e.g. POP3_LOGIN_DELAY=300 or autologout-timeout: 600, as is the loginDelay of JWTs and HTTP basic auth.
+func getDuration(v *viper.Viper, key string) time.Duration {
+	if seconds, err := strconv.ParseFloat(strings.TrimSpace(fmt.Sprint(v.Get(key))), 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return v.GetDuration(key)
+}
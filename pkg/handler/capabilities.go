@@ -0,0 +1,115 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/markushinz/aws-ses-pop3-server/pkg/provider"
+)
+
+type capability struct {
+	name string
+	// optional capabilities are announced unless the provider of the user does not support them.
+	optional bool
+	// args returns the arguments of the capability and whether it is announced in the current session.
+	// Capabilities without args are always announced.
+	args func(handler *pop3Handler) (args []string, announce bool)
+}
+
+// capabilities lists the capabilities in the order in which they are announced by CAPA.
+// Source: https://www.ietf.org/rfc/rfc2449.txt
+var capabilities = []capability{
+	{name: provider.CapabilityTOP, optional: true},
+	{name: provider.CapabilityUIDL, optional: true},
+	{name: "RESP-CODES"},
+	{name: "AUTH-RESP-CODE"},
+	{name: "PIPELINING"},
+	{name: "UTF8", args: func(handler *pop3Handler) (args []string, announce bool) {
+		return []string{"USER"}, true
+	}},
+	{name: "LANG"},
+	{name: "USER", args: func(handler *pop3Handler) (args []string, announce bool) {
+		return nil, handler.state == stateAuthorization && !handler.plaintextAuthDisabled()
+	}},
+	{name: "EXPIRE", args: func(handler *pop3Handler) (args []string, announce bool) {
+		policy, userTag := handler.policy()
+		return append([]string{policy.Expire}, userTag...), policy.Expire != ""
+	}},
+	{name: "LOGIN-DELAY", args: func(handler *pop3Handler) (args []string, announce bool) {
+		policy, userTag := handler.policy()
+		return append([]string{fmt.Sprint(policy.LoginDelay)}, userTag...), policy.LoginDelay > 0
+	}},
+	{name: "SASL", args: func(handler *pop3Handler) (args []string, announce bool) {
+		return handler.options.SASLMechanisms, handler.state == stateAuthorization && len(handler.options.SASLMechanisms) > 0 && !handler.plaintextAuthDisabled()
+	}},
+	// STLS is only permitted in the AUTHORIZATION state.
+	// Source: https://www.ietf.org/rfc/rfc2595.txt
+	{name: "STLS", args: func(handler *pop3Handler) (args []string, announce bool) {
+		return nil, handler.state == stateAuthorization && handler.tlsState == TLSAvailable
+	}},
+	{name: "IMPLEMENTATION", args: func(handler *pop3Handler) (args []string, announce bool) {
+		return []string{handler.options.Implementation}, handler.options.Implementation != ""
+	}},
+}
+
+// policy returns the policy of the user once logged in. Before, the defaults are returned together
+// with the USER tag if they may vary per user.
+func (handler *pop3Handler) policy() (policy provider.Policy, userTag []string) {
+	if handler.state == stateTransaction {
+		return handler.cache.policy, nil
+	}
+	if handler.options.PolicyPerUser {
+		return handler.options.Policy, []string{"USER"}
+	}
+	return handler.options.Policy, nil
+}
+
+// supports reports whether the provider of the user supports the optional capability.
+// Before the login, all optional capabilities are assumed to be supported.
+func (handler *pop3Handler) supports(name string) bool {
+	capabilityProvider, ok := handler.cache.provider.(provider.CapabilityProvider)
+	if !ok {
+		return true
+	}
+	for _, supported := range capabilityProvider.Capabilities() {
+		if strings.EqualFold(supported, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler *pop3Handler) handleCAPA(args []string) (response string) {
+	var lines []string
+	for _, capability := range capabilities {
+		if capability.optional && !handler.supports(capability.name) {
+			continue
+		}
+		line := capability.name
+		if capability.args != nil {
+			args, announce := capability.args(handler)
+			if !announce {
+				continue
+			}
+			line = strings.Join(append([]string{line}, args...), " ")
+		}
+		lines = append(lines, line)
+	}
+	return handler.multiLine("+OK", lines)
+}
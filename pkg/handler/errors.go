@@ -0,0 +1,80 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/markushinz/aws-ses-pop3-server/pkg/provider"
+)
+
+var (
+	errInvalidMessage        = errors.New("invalid message")
+	errInvalidState          = errors.New("command not valid in this state")
+	errUnknownCommand        = errors.New("unknown command")
+	errUnsupported           = errors.New("not supported")
+	errPlaintextAuthDisabled = errors.New("plaintext authentication disabled")
+	errAuthCancelled         = errors.New("authentication cancelled")
+	errAlreadyDeleted        = errors.New("message already deleted")
+	errNotRemoved            = errors.New("some deleted messages not removed")
+	errInvalidLanguage       = errors.New("invalid language")
+	// errUnexpected is reported instead of errors without an entry in responseCodes.
+	errUnexpected = errors.New("unexpected error")
+)
+
+// responseCodes maps errors to extended response codes.
+// Source: https://www.ietf.org/rfc/rfc2449.txt, https://www.ietf.org/rfc/rfc3206.txt
+var responseCodes = []struct {
+	err  error
+	code string
+}{
+	{err: provider.ErrAuth, code: "AUTH"},
+	{err: provider.ErrLoginDelay, code: "LOGIN-DELAY"},
+	{err: provider.ErrInUse, code: "IN-USE"},
+	{err: errNotRemoved, code: "SYS/TEMP"},
+	{err: provider.ErrMaildropTooLarge, code: "SYS/TEMP"},
+	{err: provider.ErrTemporary, code: "SYS/TEMP"},
+	{err: provider.ErrPermanent, code: "SYS/PERM"},
+	{err: provider.ErrNoSuchEmail},
+	{err: errInvalidMessage},
+	{err: errInvalidState},
+	{err: errUnknownCommand},
+	{err: errUnsupported},
+	{err: errPlaintextAuthDisabled},
+	{err: errAuthCancelled},
+	{err: errAlreadyDeleted},
+	{err: errInvalidLanguage},
+}
+
+// errorResponse returns the negative response for err. Known errors are reported with their
+// extended response code (if any) and a human-readable text in lang that does not leak any details.
+// Unknown errors are logged and reported as errUnexpected.
+func errorResponse(err error, lang language) string {
+	for _, responseCode := range responseCodes {
+		if errors.Is(err, responseCode.err) {
+			text := lang.text(responseCode.err.Error())
+			if responseCode.code == "" {
+				return fmt.Sprintf("-ERR %v", text)
+			}
+			return fmt.Sprintf("-ERR [%v] %v", responseCode.code, text)
+		}
+	}
+	log.Printf("Error errorResponse(): unexpected error: %v", err)
+	return fmt.Sprintf("-ERR %v", lang.text(errUnexpected.Error()))
+}
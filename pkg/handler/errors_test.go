@@ -0,0 +1,111 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/markushinz/aws-ses-pop3-server/pkg/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponse(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		err  error
+		lang language
+		want string
+	}{
+		{
+			name: "auth",
+			err:  fmt.Errorf("%w: credentials do not match user/password", provider.ErrAuth),
+			want: "-ERR [AUTH] invalid credentials",
+		},
+		{
+			name: "temporary",
+			err:  fmt.Errorf("%w: RequestError: send request failed", provider.ErrTemporary),
+			want: "-ERR [SYS/TEMP] temporary failure, try again later",
+		},
+		{
+			name: "permanent",
+			err:  fmt.Errorf("%w: AccessDenied", provider.ErrPermanent),
+			want: "-ERR [SYS/PERM] permanent failure, contact your administrator",
+		},
+		{
+			name: "in use",
+			err:  provider.ErrInUse,
+			want: "-ERR [IN-USE] maildrop already in use",
+		},
+		{
+			name: "login delay",
+			err:  provider.ErrLoginDelay,
+			want: "-ERR [LOGIN-DELAY] minimum time between logins not yet elapsed",
+		},
+		{
+			name: "without response code",
+			err:  fmt.Errorf("%w: 7 does not exist", provider.ErrNoSuchEmail),
+			want: "-ERR no such message",
+		},
+		{
+			name: "not removed",
+			err:  fmt.Errorf("%w: %v", errNotRemoved, &provider.DeleteError{IDs: []string{"abc123"}}),
+			want: "-ERR [SYS/TEMP] some deleted messages not removed",
+		},
+		{
+			name: "already deleted",
+			err:  fmt.Errorf("%w: 1", errAlreadyDeleted),
+			want: "-ERR message already deleted",
+		},
+		{
+			name: "maildrop too large",
+			err:  fmt.Errorf("%w: more than 1000 emails", provider.ErrMaildropTooLarge),
+			want: "-ERR [SYS/TEMP] maildrop too large",
+		},
+		{
+			name: "German",
+			err:  fmt.Errorf("%w: credentials do not match user/password", provider.ErrAuth),
+			lang: languages[1],
+			want: "-ERR [AUTH] ungültige Anmeldedaten",
+		},
+		{
+			name: "unknown",
+			err:  errors.New("something went wrong"),
+			want: "-ERR unexpected error",
+		},
+		{
+			name: "unknown German",
+			err:  errors.New("something went wrong"),
+			lang: languages[1],
+			want: "-ERR unerwarteter Fehler",
+		},
+		{
+			name: "SASL",
+			err:  fmt.Errorf("%w: missing terminating ^A^A", errInvalidMessage),
+			want: "-ERR invalid message",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.EqualValues(t, tt.want, errorResponse(tt.err, tt.lang))
+		})
+	}
+}
@@ -16,8 +16,39 @@
 
 package handler
 
-type HandlerCreator func() (handler Handler, response string, err error)
+import (
+	"io"
+	"time"
+)
+
+type TLSState int
+
+const (
+	// TLSUnavailable means the connection is not encrypted and cannot be upgraded.
+	TLSUnavailable TLSState = iota
+	// TLSAvailable means the connection is not encrypted but can be upgraded using STLS.
+	TLSAvailable
+	// TLSActive means the connection is encrypted.
+	TLSActive
+)
+
+type Action int
+
+const (
+	ActionNone Action = iota
+	// ActionQuit tells the server to close the connection after sending the responses.
+	ActionQuit
+	// ActionSTLS tells the server to perform a TLS handshake after sending the responses.
+	ActionSTLS
+)
+
+type HandlerCreator func(tlsState TLSState) (handler Handler, response string, err error)
 
 type Handler interface {
-	Handle(message string) (responses []string, quit bool)
+	// Handle processes message and writes the response to writer. If err is not nil,
+	// the response could not be written completely and the connection must be closed.
+	Handle(message string, writer io.Writer) (action Action, err error)
+	// Timeouts returns how long to wait for the next command and for each write of a response.
+	// A zero duration means no timeout.
+	Timeouts() (read, write time.Duration)
 }
@@ -0,0 +1,94 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"strings"
+)
+
+const (
+	textLanguageListing = "Language listing follows"
+	textLanguageChanged = "Language changed"
+)
+
+// language is an entry of the message catalog. Texts maps the English response texts to their
+// translation and falls back to English for missing entries.
+type language struct {
+	tag         string
+	description string
+	texts       map[string]string
+}
+
+// languages lists the supported languages. The first one is the default.
+// Source: https://www.ietf.org/rfc/rfc6856.txt
+var languages = []language{
+	{tag: "en", description: "English"},
+	{tag: "de", description: "Deutsch", texts: map[string]string{
+		textLanguageListing:                             "Liste der Sprachen folgt",
+		textLanguageChanged:                             "Sprache geändert",
+		"invalid credentials":                           "ungültige Anmeldedaten",
+		"temporary failure, try again later":            "vorübergehender Fehler, bitte später erneut versuchen",
+		"permanent failure, contact your administrator": "dauerhafter Fehler, bitte wenden Sie sich an Ihren Administrator",
+		"maildrop already in use":                       "Postfach wird bereits verwendet",
+		"minimum time between logins not yet elapsed":   "Mindestzeit zwischen Anmeldungen noch nicht abgelaufen",
+		"no such message":                               "Nachricht existiert nicht",
+		"maildrop too large":                            "Postfach zu groß",
+		"invalid message":                               "ungültige Nachricht",
+		"command not valid in this state":               "Befehl in diesem Zustand nicht zulässig",
+		"unknown command":                               "unbekannter Befehl",
+		"not supported":                                 "nicht unterstützt",
+		"plaintext authentication disabled":             "Klartext-Anmeldung deaktiviert",
+		"authentication cancelled":                      "Anmeldung abgebrochen",
+		"message already deleted":                       "Nachricht bereits gelöscht",
+		"some deleted messages not removed":             "einige gelöschte Nachrichten wurden nicht entfernt",
+		"invalid language":                              "ungültige Sprache",
+		"unexpected error":                              "unerwarteter Fehler",
+	}},
+}
+
+func (lang language) text(text string) string {
+	if translation, exists := lang.texts[text]; exists {
+		return translation
+	}
+	return text
+}
+
+// findLanguage returns the language matching the language range using the lookup scheme of RFC 4647,
+// i.e. subtags are removed from the end until a supported tag matches. "*" selects the default.
+func findLanguage(languageRange string) (lang language, found bool) {
+	if languageRange == "*" {
+		return languages[0], true
+	}
+	tag := strings.ToLower(languageRange)
+	for tag != "" {
+		for _, lang := range languages {
+			if lang.tag == tag {
+				return lang, true
+			}
+		}
+		index := strings.LastIndex(tag, "-")
+		if index < 0 {
+			break
+		}
+		tag = tag[:index]
+		// Singletons such as the x of private use subtags are removed together with the following subtag.
+		if index := strings.LastIndex(tag, "-"); index >= 0 && index == len(tag)-2 {
+			tag = tag[:index]
+		}
+	}
+	return language{}, false
+}
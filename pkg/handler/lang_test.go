@@ -0,0 +1,61 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindLanguage(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		languageRange string
+		wantTag       string
+		wantFound     bool
+	}{
+		{languageRange: "en", wantTag: "en", wantFound: true},
+		{languageRange: "DE", wantTag: "de", wantFound: true},
+		{languageRange: "de-CH", wantTag: "de", wantFound: true},
+		{languageRange: "de-Latn-x-foo", wantTag: "de", wantFound: true},
+		{languageRange: "*", wantTag: "en", wantFound: true},
+		{languageRange: "fr"},
+		{languageRange: "fr-de"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.languageRange, func(t *testing.T) {
+			t.Parallel()
+			lang, found := findLanguage(tt.languageRange)
+			assert.EqualValues(t, tt.wantFound, found)
+			assert.EqualValues(t, tt.wantTag, lang.tag)
+		})
+	}
+}
+
+func TestLanguageTexts(t *testing.T) {
+	t.Parallel()
+	for _, responseCode := range responseCodes {
+		for _, lang := range languages[1:] {
+			assert.Contains(t, lang.texts, responseCode.err.Error(), lang.tag)
+		}
+	}
+	for _, lang := range languages[1:] {
+		assert.Contains(t, lang.texts, errUnexpected.Error(), lang.tag)
+	}
+}
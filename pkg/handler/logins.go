@@ -0,0 +1,65 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/markushinz/aws-ses-pop3-server/pkg/provider"
+)
+
+// LoginTable records the time of the last successful login of every user so that the minimum time
+// between logins announced via LOGIN-DELAY can be enforced. It is shared by all sessions of a server.
+type LoginTable struct {
+	mu     sync.Mutex
+	logins map[string]time.Time
+	// maxDelay is the longest delay recorded so far. Older logins cannot cause a rejection and are evicted.
+	maxDelay time.Duration
+	// evicted is the time of the last eviction which takes place at most once per maxDelay.
+	evicted time.Time
+}
+
+func NewLoginTable() *LoginTable {
+	return &LoginTable{
+		logins: make(map[string]time.Time),
+	}
+}
+
+// record stores now as the last login of identity unless the previous login happened less than delay ago.
+// Rejected logins are not recorded so that they do not extend the delay.
+func (table *LoginTable) record(identity string, delay time.Duration, now time.Time) (err error) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if delay > table.maxDelay {
+		table.maxDelay = delay
+	}
+	if now.Sub(table.evicted) >= table.maxDelay {
+		for other, last := range table.logins {
+			if now.Sub(last) >= table.maxDelay {
+				delete(table.logins, other)
+			}
+		}
+		table.evicted = now
+	}
+	if last, exists := table.logins[identity]; exists && delay > 0 && now.Sub(last) < delay {
+		return fmt.Errorf("%w: %v remaining", provider.ErrLoginDelay, (delay - now.Sub(last)).Round(time.Second))
+	}
+	table.logins[identity] = now
+	return nil
+}
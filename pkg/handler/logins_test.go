@@ -0,0 +1,49 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/markushinz/aws-ses-pop3-server/pkg/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginTable(t *testing.T) {
+	t.Parallel()
+	table := NewLoginTable()
+	now := time.Now()
+
+	assert.NoError(t, table.record("user", time.Minute, now))
+	assert.ErrorIs(t, table.record("user", time.Minute, now.Add(30*time.Second)), provider.ErrLoginDelay)
+	// The rejected login must not extend the delay.
+	assert.NoError(t, table.record("user", time.Minute, now.Add(time.Minute)))
+	assert.NoError(t, table.record("user", 0, now.Add(time.Minute)))
+	assert.NoError(t, table.record("other", time.Minute, now))
+
+	// Logins older than the longest delay are evicted.
+	assert.NoError(t, table.record("later", time.Minute, now.Add(2*time.Minute)))
+	assert.Len(t, table.logins, 1)
+
+	// Until the longest delay has passed since the last eviction, old logins are kept.
+	assert.NoError(t, table.record("next", time.Minute, now.Add(2*time.Minute+10*time.Second)))
+	assert.NoError(t, table.record("last", time.Minute, now.Add(2*time.Minute+50*time.Second)))
+	assert.Len(t, table.logins, 3)
+	assert.NoError(t, table.record("final", time.Minute, now.Add(3*time.Minute+20*time.Second)))
+	assert.Len(t, table.logins, 2)
+}
@@ -17,94 +17,333 @@
 package handler
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/markushinz/aws-ses-pop3-server/pkg/provider"
 )
 
 type pop3Cache struct {
-	user     *string
 	provider provider.Provider
+	policy   provider.Policy
 	dele     []int
+	// downgradeDeltas holds by how many octets downgrading the headers changes the size of each email.
+	downgradeDeltas map[int]int64
+}
+
+type POP3Options struct {
+	Verbose bool
+	// DisablePlaintextAuth refuses USER / PASS and AUTH until the connection is encrypted.
+	DisablePlaintextAuth bool
+	// SASLMechanisms lists the mechanisms offered via AUTH in the order of preference.
+	SASLMechanisms []string
+	// APOPProviderCreator enables APOP if the credential source can verify APOP digests.
+	APOPProviderCreator provider.APOPProviderCreator
+	// PreAuthTimeout limits the inactivity before the client is authenticated.
+	PreAuthTimeout time.Duration
+	// AutologoutTimeout limits the inactivity once the client is authenticated.
+	AutologoutTimeout time.Duration
+	// WriteTimeout limits each write of a response so that large responses to stalled clients do not block forever.
+	WriteTimeout time.Duration
+	// DowngradeHeaders encodes non-ASCII header fields for clients that have not enabled UTF8.
+	DowngradeHeaders bool
+	// Policy is the default retention and minimum time between logins announced via EXPIRE and LOGIN-DELAY.
+	Policy provider.Policy
+	// PolicyPerUser indicates that providers may override Policy for their user.
+	PolicyPerUser bool
+	// Implementation is announced via the IMPLEMENTATION capability if not empty.
+	Implementation string
+	// Logins enforces the login delay across the sessions; NewPOP3HandlerCreator creates one if not set.
+	Logins *LoginTable
 }
 
 type pop3Handler struct {
 	providerCreator provider.ProviderCreator
-	verbose         bool
-	cache           pop3Cache
+	options         POP3Options
+	tlsState        TLSState
+	timestamp       string
+	state           pop3State
+	action          Action
+	// user is set by USER and consumed by the directly following PASS.
+	user  *string
+	utf8  bool
+	lang  language
+	cache pop3Cache
+	sasl  saslMechanism
+	// body makes the response a multi-line response.
+	body *multiLineBody
+}
+
+// multiLineBody is sent after the status line of a multi-line response and followed by the termination line.
+type multiLineBody struct {
+	// lines are sent if reader is nil.
+	lines  []string
+	reader io.ReadCloser
+	// bodyLines limits the lines of a message following its headers; -1 means the whole message.
+	bodyLines int
 }
 
 var _ Handler = &pop3Handler{}
 
-func NewPOP3HandlerCreator(providerCreator provider.ProviderCreator, verbose bool) HandlerCreator {
-	return func() (handler Handler, response string, err error) {
-		return newPOP3Handler(providerCreator, verbose)
+func NewPOP3HandlerCreator(providerCreator provider.ProviderCreator, options POP3Options) HandlerCreator {
+	var mechanisms []string
+	for _, mechanism := range options.SASLMechanisms {
+		mechanism = strings.ToUpper(mechanism)
+		if _, exists := saslMechanisms[mechanism]; !exists {
+			log.Printf("Warning: Unsupported SASL mechanism %q will be ignored", mechanism)
+			continue
+		}
+		mechanisms = append(mechanisms, mechanism)
+	}
+	options.SASLMechanisms = mechanisms
+	if options.Logins == nil {
+		options.Logins = NewLoginTable()
+	}
+	return func(tlsState TLSState) (handler Handler, response string, err error) {
+		return newPOP3Handler(providerCreator, options, tlsState)
 	}
 }
 
-func newPOP3Handler(providerCreator provider.ProviderCreator, verbose bool) (handler *pop3Handler, responses string, err error) {
-	if err != nil {
-		return nil, "", err
-	}
+func newPOP3Handler(providerCreator provider.ProviderCreator, options POP3Options, tlsState TLSState) (handler *pop3Handler, responses string, err error) {
 	handler = &pop3Handler{
 		providerCreator: providerCreator,
-		verbose:         verbose,
+		options:         options,
+		tlsState:        tlsState,
+		state:           stateAuthorization,
+		lang:            languages[0],
 	}
 	response := "+OK"
-	handler.log([]string{response}, false, verbose)
+	if options.APOPProviderCreator != nil {
+		handler.timestamp, err = newTimestamp()
+		if err != nil {
+			return nil, "", err
+		}
+		response += " " + handler.timestamp
+	}
+	handler.log([]string{response}, false, options.Verbose)
 	return handler, response, nil
 }
 
-func (handler *pop3Handler) getState() string {
-	if handler.cache.provider == nil {
-		return "AUTHORIZATION"
-	}
-	return "TRANSACTION"
-}
-
-func (handler *pop3Handler) Handle(message string) (responses []string, quit bool) {
-	handler.log([]string{message}, true, handler.verbose)
-	switch {
-	case message == "CAPA":
-		responses = handler.handleCAPA()
-	case strings.HasPrefix(message, "USER"):
-		responses = handler.handleUSER(message)
-	case strings.HasPrefix(message, "PASS"):
-		responses = handler.handlePASS(message)
-	case handler.getState() != "TRANSACTION":
-		responses = []string{"-ERR"}
-	case message == "STAT":
-		responses = handler.handleSTAT()
-	case message == "UIDL":
-		responses = handler.handleUIDL()
-	case strings.HasPrefix(message, "UIDL"):
-		responses = handler.handleUIDLn(message)
-	case message == "LIST":
-		responses = handler.handleLIST()
-	case strings.HasPrefix(message, "LIST"):
-		responses = handler.handleLISTn(message)
-	case strings.HasPrefix(message, "TOP"):
-		responses = handler.handleTOP(message)
-	case strings.HasPrefix(message, "RETR"):
-		responses = handler.handleRETR(message)
-	case strings.HasPrefix(message, "DELE"):
-		responses = handler.handleDELE(message)
-	case message == "NOOP":
-		responses = []string{"+OK"}
-	case message == "RSET":
-		handler.cache.dele = nil
-		responses = []string{"+OK"}
-	case message == "QUIT":
-		responses = handler.handleQUIT()
-		quit = true
-	default:
-		responses = []string{"-ERR"}
-	}
-	handler.log(responses, false, handler.verbose)
-	return responses, quit
+// newTimestamp returns a banner timestamp of the form <process-ID.random.clock@hostname>
+// that is unique for every connection.
+// Source: https://www.ietf.org/rfc/rfc1939.txt
+func newTimestamp() (timestamp string, err error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	return fmt.Sprintf("<%v.%v.%v@%v>", os.Getpid(), hex.EncodeToString(random), time.Now().Unix(), hostname), nil
+}
+
+type pop3State string
+
+const (
+	stateAuthorization pop3State = "AUTHORIZATION"
+	stateTransaction   pop3State = "TRANSACTION"
+	stateUpdate        pop3State = "UPDATE"
+)
+
+type pop3Command struct {
+	handle  func(handler *pop3Handler, args []string) (response string)
+	minArgs int
+	maxArgs int
+	// capability names the optional capability the provider of the user has to support.
+	capability string
+}
+
+// pop3Commands lists the commands that are valid in each state.
+// Source: https://www.ietf.org/rfc/rfc1939.txt
+var pop3Commands = map[pop3State]map[string]pop3Command{
+	stateAuthorization: {
+		"CAPA": {handle: (*pop3Handler).handleCAPA},
+		"STLS": {handle: (*pop3Handler).handleSTLS},
+		"UTF8": {handle: (*pop3Handler).handleUTF8},
+		"LANG": {handle: (*pop3Handler).handleLANG, maxArgs: 1},
+		"AUTH": {handle: (*pop3Handler).handleAUTH, maxArgs: 2},
+		"APOP": {handle: (*pop3Handler).handleAPOP, minArgs: 2, maxArgs: 2},
+		"USER": {handle: (*pop3Handler).handleUSER, minArgs: 1, maxArgs: 1},
+		"PASS": {handle: (*pop3Handler).handlePASS, minArgs: 1, maxArgs: 1},
+		"QUIT": {handle: (*pop3Handler).handleQUIT},
+	},
+	stateTransaction: {
+		"CAPA": {handle: (*pop3Handler).handleCAPA},
+		"LANG": {handle: (*pop3Handler).handleLANG, maxArgs: 1},
+		"STAT": {handle: (*pop3Handler).handleSTAT},
+		"LIST": {handle: (*pop3Handler).handleLIST, maxArgs: 1},
+		"UIDL": {handle: (*pop3Handler).handleUIDL, maxArgs: 1, capability: "UIDL"},
+		"TOP":  {handle: (*pop3Handler).handleTOP, minArgs: 2, maxArgs: 2, capability: "TOP"},
+		"RETR": {handle: (*pop3Handler).handleRETR, minArgs: 1, maxArgs: 1},
+		"DELE": {handle: (*pop3Handler).handleDELE, minArgs: 1, maxArgs: 1},
+		"NOOP": {handle: (*pop3Handler).handleNOOP},
+		"RSET": {handle: (*pop3Handler).handleRSET},
+		"QUIT": {handle: (*pop3Handler).handleQUIT},
+	},
+	stateUpdate: {},
+}
+
+func (handler *pop3Handler) Handle(message string, writer io.Writer) (action Action, err error) {
+	handler.log([]string{message}, true, handler.options.Verbose)
+	handler.action = ActionNone
+	handler.body = nil
+	var response string
+	if handler.sasl != nil {
+		response = handler.handleSASLResponse(message)
+	} else {
+		response = handler.dispatch(message)
+	}
+	return handler.action, handler.write(writer, response)
+}
+
+func (handler *pop3Handler) multiLine(status string, lines []string) (response string) {
+	handler.body = &multiLineBody{lines: lines, bodyLines: -1}
+	return status
+}
+
+func (handler *pop3Handler) errorResponse(err error) (response string) {
+	return errorResponse(err, handler.lang)
+}
+
+func (handler *pop3Handler) write(writer io.Writer, response string) (err error) {
+	if _, err := io.WriteString(writer, response+"\r\n"); err != nil {
+		return err
+	}
+	if handler.body == nil {
+		handler.log([]string{response}, false, handler.options.Verbose)
+		return nil
+	}
+	reader := handler.body.reader
+	if reader == nil {
+		handler.log(append(append([]string{response}, handler.body.lines...), "."), false, handler.options.Verbose)
+		var content strings.Builder
+		for _, line := range handler.body.lines {
+			content.WriteString(line + "\r\n")
+		}
+		reader = io.NopCloser(strings.NewReader(content.String()))
+	}
+	defer reader.Close()
+	written, err := provider.EncodeMessage(writer, reader, handler.body.bodyLines)
+	if err != nil {
+		log.Printf("Error provider.EncodeMessage(): %v", err)
+		return err
+	}
+	if handler.body.reader != nil {
+		handler.log([]string{response, fmt.Sprintf("[ %v octets ]", written), "."}, false, handler.options.Verbose)
+	}
+	_, err = io.WriteString(writer, ".\r\n")
+	return err
+}
+
+// Timeouts implements the autologout timer. If it expires, the server closes the connection
+// without entering the UPDATE state so that no messages are removed.
+// Source: https://www.ietf.org/rfc/rfc1939.txt
+func (handler *pop3Handler) Timeouts() (read, write time.Duration) {
+	if handler.state == stateAuthorization {
+		return handler.options.PreAuthTimeout, handler.options.WriteTimeout
+	}
+	return handler.options.AutologoutTimeout, handler.options.WriteTimeout
+}
+
+func (handler *pop3Handler) dispatch(message string) (response string) {
+	keyword, args := parseMessage(message)
+	// PASS is only valid immediately after a successful USER.
+	user := handler.user
+	handler.user = nil
+	command, exists := pop3Commands[handler.state][keyword]
+	if !exists {
+		err := errUnknownCommand
+		for _, commands := range pop3Commands {
+			if _, exists := commands[keyword]; exists {
+				err = errInvalidState
+			}
+		}
+		log.Printf("Error dispatch(): %v: %q", err, keyword)
+		return handler.errorResponse(err)
+	}
+	if command.capability != "" && !handler.supports(command.capability) {
+		err := errUnsupported
+		log.Printf("Error dispatch(): %v: %q is not supported by the provider", err, keyword)
+		return handler.errorResponse(err)
+	}
+	if len(args) < command.minArgs || len(args) > command.maxArgs {
+		err := errInvalidMessage
+		log.Printf("Error dispatch(): %v: %q expects between %v and %v arguments", err, keyword, command.minArgs, command.maxArgs)
+		return handler.errorResponse(err)
+	}
+	for _, arg := range args {
+		if arg == "" {
+			err := errInvalidMessage
+			log.Printf("Error dispatch(): %v: %q has an empty argument", err, keyword)
+			return handler.errorResponse(err)
+		}
+	}
+	if keyword == "PASS" {
+		handler.user = user
+	}
+	return command.handle(handler, args)
+}
+
+// parseMessage splits message into the case-insensitive keyword and its arguments that are separated by single spaces.
+// As passwords may contain spaces, the argument of PASS is everything following the keyword.
+func parseMessage(message string) (keyword string, args []string) {
+	keyword, rest, found := strings.Cut(message, " ")
+	keyword = strings.ToUpper(keyword)
+	if !found {
+		return keyword, nil
+	}
+	if keyword == "PASS" {
+		return keyword, []string{rest}
+	}
+	return keyword, strings.Split(rest, " ")
+}
+
+// parseNumber parses a non-negative decimal number that consists of digits only.
+func parseNumber(arg string) (number int, err error) {
+	if arg == "" || strings.Trim(arg, "0123456789") != "" {
+		return 0, fmt.Errorf("%w: %q is not a number", errInvalidMessage, arg)
+	}
+	number, err = strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errInvalidMessage, err)
+	}
+	return number, nil
+}
+
+// parseMessageNumber parses a message number which starts at 1 and must not refer to a message marked as deleted.
+func (handler *pop3Handler) parseMessageNumber(arg string) (number int, err error) {
+	number, err = parseNumber(arg)
+	if err != nil {
+		return 0, err
+	}
+	if number < 1 {
+		return 0, fmt.Errorf("%w: %v", provider.ErrNoSuchEmail, number)
+	}
+	if handler.isDeleted(number) {
+		return 0, fmt.Errorf("%w: %v", errAlreadyDeleted, number)
+	}
+	return number, nil
+}
+
+func (handler *pop3Handler) isDeleted(number int) bool {
+	for _, deleted := range handler.cache.dele {
+		if deleted == number {
+			return true
+		}
+	}
+	return false
 }
 
 func (handler *pop3Handler) log(data []string, incoming bool, verbose bool) {
@@ -113,216 +352,457 @@ func (handler *pop3Handler) log(data []string, incoming bool, verbose bool) {
 		prefix = "<--"
 	}
 	for index, datum := range data {
-		if incoming && strings.HasPrefix(datum, "PASS") {
-			datum = "PASS [ *** ]"
+		if incoming {
+			keyword, args := parseMessage(datum)
+			switch {
+			case handler.sasl != nil:
+				datum = "[ *** ]"
+			case keyword == "PASS":
+				datum = "PASS [ *** ]"
+			case keyword == "AUTH" && len(args) > 1:
+				datum = "AUTH " + args[0] + " [ *** ]"
+			}
 		}
 		if index == 0 || index == len(data)-1 || verbose {
-			log.Printf("%v %v %v", handler.getState(), prefix, datum)
+			log.Printf("%v %v %v", handler.state, prefix, datum)
 		} else if index == len(data)-2 {
-			log.Printf("%v %v [ ... ]", handler.getState(), prefix)
+			log.Printf("%v %v [ ... ]", handler.state, prefix)
 		}
 	}
 }
-func (handler *pop3Handler) handleCAPA() (responses []string) {
-	return []string{"+OK", "TOP", "UIDL", "USER", "."}
+
+func (handler *pop3Handler) handleSTLS(args []string) (response string) {
+	if handler.tlsState != TLSAvailable {
+		err := errInvalidState
+		log.Printf("Error handleSTLS(): %v", err)
+		return handler.errorResponse(err)
+	}
+	// The client must discard any knowledge obtained prior to the TLS negotiation.
+	// Source: https://www.ietf.org/rfc/rfc2595.txt
+	handler.cache = pop3Cache{}
+	handler.lang = languages[0]
+	handler.utf8 = false
+	handler.tlsState = TLSActive
+	handler.action = ActionSTLS
+	return "+OK"
+}
+
+// handleUTF8 enables UTF-8 mode so that messages are sent without downgrading their headers.
+// USER, PASS and AUTH accept UTF-8 regardless as announced by the USER argument of the UTF8 capability.
+// Source: https://www.ietf.org/rfc/rfc6856.txt
+func (handler *pop3Handler) handleUTF8(args []string) (response string) {
+	handler.utf8 = true
+	return "+OK"
+}
+
+// handleLANG lists the supported languages or changes the language of the response texts for the session.
+// Source: https://www.ietf.org/rfc/rfc6856.txt
+func (handler *pop3Handler) handleLANG(args []string) (response string) {
+	if len(args) == 0 {
+		var lines []string
+		for _, lang := range languages {
+			lines = append(lines, lang.tag+" "+lang.description)
+		}
+		return handler.multiLine("+OK "+handler.lang.text(textLanguageListing), lines)
+	}
+	lang, found := findLanguage(args[0])
+	if !found {
+		err := fmt.Errorf("%w: %q", errInvalidLanguage, args[0])
+		log.Printf("Error handleLANG(): %v", err)
+		return handler.errorResponse(err)
+	}
+	handler.lang = lang
+	return fmt.Sprintf("+OK %v %v", lang.tag, lang.text(textLanguageChanged))
+}
+
+func (handler *pop3Handler) plaintextAuthDisabled() bool {
+	return handler.options.DisablePlaintextAuth && handler.tlsState != TLSActive
 }
 
-func (handler *pop3Handler) handleUSER(message string) (responses []string) {
-	if len(strings.Split(message, " ")) < 2 {
-		err := fmt.Errorf("invalid message")
+func (handler *pop3Handler) handleUSER(args []string) (response string) {
+	if handler.plaintextAuthDisabled() {
+		err := errPlaintextAuthDisabled
+		log.Printf("Error handleUSER(): %v", err)
+		return handler.errorResponse(err)
+	}
+	user := args[0]
+	if !utf8.ValidString(user) {
+		err := fmt.Errorf("%w: user is not valid UTF-8", errInvalidMessage)
 		log.Printf("Error handleUSER(): %v", err)
-		return []string{"-ERR"}
+		return handler.errorResponse(err)
 	}
-	user := strings.TrimPrefix(message, "USER ")
-	handler.cache.user = &user
-	return []string{"+OK"}
+	handler.user = &user
+	return "+OK"
 }
 
-func (handler *pop3Handler) handlePASS(message string) (responses []string) {
-	if len(strings.Split(message, " ")) < 2 {
-		err := fmt.Errorf("invalid message")
+func (handler *pop3Handler) handlePASS(args []string) (response string) {
+	if handler.plaintextAuthDisabled() {
+		err := errPlaintextAuthDisabled
 		log.Printf("Error handlePASS(): %v", err)
-		return []string{"-ERR"}
+		return handler.errorResponse(err)
 	}
-	password := strings.TrimPrefix(message, "PASS ")
-	provider, err := handler.providerCreator(*handler.cache.user, password)
-	if err != nil {
+	user := handler.user
+	handler.user = nil
+	if user == nil {
+		err := fmt.Errorf("%w: PASS without USER", errInvalidState)
 		log.Printf("Error handlePASS(): %v", err)
-		return []string{"-ERR"}
+		return handler.errorResponse(err)
+	}
+	if err := handler.authenticate(*user, args[0]); err != nil {
+		log.Printf("Error handler.authenticate(): %v", err)
+		return handler.errorResponse(err)
 	}
-	handler.cache.provider = provider
-	return []string{"+OK"}
+	return "+OK"
 }
 
-func (handler *pop3Handler) handleSTAT() (responses []string) {
-	emails, err := handler.cache.provider.ListEmails(handler.cache.dele)
+func (handler *pop3Handler) handleAPOP(args []string) (response string) {
+	if handler.options.APOPProviderCreator == nil {
+		err := errUnsupported
+		log.Printf("Error handleAPOP(): %v", err)
+		return handler.errorResponse(err)
+	}
+	user, digest := args[0], args[1]
+	provider, err := handler.options.APOPProviderCreator(user, handler.timestamp, digest)
 	if err != nil {
-		log.Printf("Error handler.cache.provider.ListEmails(): %v", err)
-		return []string{"-ERR"}
+		log.Printf("Error handler.options.APOPProviderCreator(): %v", err)
+		return handler.errorResponse(err)
 	}
-	var totalSize int64
-	for _, email := range emails {
-		totalSize += email.Size
+	if err := handler.login(user, provider); err != nil {
+		log.Printf("Error handler.login(): %v", err)
+		return handler.errorResponse(err)
 	}
-	return []string{fmt.Sprintf("+OK %v %v", len(emails), totalSize)}
+	return "+OK"
 }
 
-func (handler *pop3Handler) handleUIDL() (responses []string) {
-	emails, err := handler.cache.provider.ListEmails(handler.cache.dele)
+func (handler *pop3Handler) handleAUTH(args []string) (response string) {
+	if len(args) == 0 {
+		return handler.multiLine("+OK", handler.options.SASLMechanisms)
+	}
+	if handler.plaintextAuthDisabled() {
+		err := errPlaintextAuthDisabled
+		log.Printf("Error handleAUTH(): %v", err)
+		return handler.errorResponse(err)
+	}
+	name := strings.ToUpper(args[0])
+	enabled := false
+	for _, mechanism := range handler.options.SASLMechanisms {
+		enabled = enabled || mechanism == name
+	}
+	if !enabled {
+		err := fmt.Errorf("%w: SASL mechanism %q", errUnsupported, name)
+		log.Printf("Error handleAUTH(): %v", err)
+		return handler.errorResponse(err)
+	}
+	mechanism := saslMechanisms[name]()
+	if len(args) == 2 {
+		initialResponse, err := decodeSASLResponse(args[1])
+		if err != nil {
+			log.Printf("Error handleAUTH(): %v", err)
+			return handler.errorResponse(errInvalidMessage)
+		}
+		return handler.nextSASL(mechanism, initialResponse)
+	}
+	handler.sasl = mechanism
+	return encodeSASLChallenge(mechanism.Start())
+}
+
+func (handler *pop3Handler) handleSASLResponse(message string) (response string) {
+	mechanism := handler.sasl
+	handler.sasl = nil
+	if message == "*" {
+		err := errAuthCancelled
+		log.Printf("Error handleSASLResponse(): %v", err)
+		return handler.errorResponse(err)
+	}
+	saslResponse, err := base64.StdEncoding.DecodeString(message)
 	if err != nil {
-		log.Printf("Error handler.cache.provider.ListEmails(): %v", err)
-		return []string{"-ERR"}
+		log.Printf("Error handleSASLResponse(): %v", err)
+		return handler.errorResponse(errInvalidMessage)
 	}
-	responses = append(responses, "+OK")
-	for _, number := range provider.GetSortedMailNumbers(emails) {
-		responses = append(responses, fmt.Sprintf("%v %v", number, emails[number].ID))
+	return handler.nextSASL(mechanism, saslResponse)
+}
+
+func (handler *pop3Handler) nextSASL(mechanism saslMechanism, saslResponse []byte) (response string) {
+	challenge, done, err := mechanism.Next(saslResponse)
+	if err != nil {
+		log.Printf("Error mechanism.Next(): %v", err)
+		return handler.errorResponse(err)
+	}
+	if !done {
+		handler.sasl = mechanism
+		return encodeSASLChallenge(challenge)
+	}
+	user, password := mechanism.Credentials()
+	if err := handler.authenticate(user, password); err != nil {
+		log.Printf("Error handler.authenticate(): %v", err)
+		if challenger, ok := mechanism.(saslFailureChallenger); ok {
+			handler.sasl = &saslFailure{err: err}
+			return encodeSASLChallenge(challenger.FailureChallenge(err))
+		}
+		return handler.errorResponse(err)
 	}
-	responses = append(responses, ".")
-	return responses
+	return "+OK"
 }
 
-func (handler *pop3Handler) handleUIDLn(message string) (responses []string) {
-	parts := strings.Split(message, " ")
-	if len(parts) != 2 {
-		err := fmt.Errorf("invalid message")
-		log.Printf("Error handleUIDLn(): %v", err)
-		return []string{"-ERR"}
+func (handler *pop3Handler) authenticate(user, password string) (err error) {
+	if !utf8.ValidString(user) || !utf8.ValidString(password) {
+		return fmt.Errorf("%w: credentials are not valid UTF-8", errInvalidMessage)
 	}
-	number, err := strconv.Atoi(parts[1])
+	provider, err := handler.providerCreator(user, password)
 	if err != nil {
-		log.Printf("Error handleUIDLn(): %v", err)
-		return []string{"-ERR"}
+		return err
 	}
-	email, err := handler.cache.provider.GetEmail(number, handler.cache.dele)
-	if err != nil {
-		log.Printf("Error handler.cache.provider.GetEmail(): %v", err)
-		return []string{"-ERR"}
+	return handler.login(user, provider)
+}
+
+// login enters the TRANSACTION state unless the minimum time between logins of the user has not elapsed yet.
+// The logins are tracked by the identity verified by the provider as user is not checked by all credential sources.
+func (handler *pop3Handler) login(user string, userProvider provider.Provider) (err error) {
+	policy := handler.options.Policy
+	if policyProvider, ok := userProvider.(provider.PolicyProvider); ok {
+		policy = policyProvider.Policy().WithDefaults(policy)
+	}
+	identity := user
+	if identityProvider, ok := userProvider.(provider.IdentityProvider); ok && identityProvider.Identity() != "" {
+		identity = identityProvider.Identity()
+	}
+	// Logins is only nil for handlers that are not created by NewPOP3HandlerCreator, e.g. in tests.
+	if handler.options.Logins != nil {
+		if err := handler.options.Logins.record(identity, time.Duration(policy.LoginDelay)*time.Second, time.Now()); err != nil {
+			return err
+		}
 	}
-	return []string{fmt.Sprintf("+OK %v %v", number, email.ID)}
+	handler.cache.provider = userProvider
+	handler.cache.policy = policy
+	handler.state = stateTransaction
+	return nil
 }
 
-func (handler *pop3Handler) handleLIST() (responses []string) {
+func (handler *pop3Handler) handleSTAT(args []string) (response string) {
 	emails, err := handler.cache.provider.ListEmails(handler.cache.dele)
 	if err != nil {
 		log.Printf("Error handler.cache.provider.ListEmails(): %v", err)
-		return []string{"-ERR"}
+		return handler.errorResponse(err)
 	}
-	responses = append(responses, "+OK")
-	for _, number := range provider.GetSortedMailNumbers(emails) {
-		responses = append(responses, fmt.Sprintf("%v %v", number, emails[number].Size))
+	var totalSize int64
+	for number, email := range emails {
+		size, err := handler.size(number, email)
+		if err != nil {
+			log.Printf("Error handler.size(): %v", err)
+			return handler.errorResponse(err)
+		}
+		totalSize += size
 	}
-	responses = append(responses, ".")
-	return responses
+	return fmt.Sprintf("+OK %v %v", len(emails), totalSize)
 }
 
-func (handler *pop3Handler) handleLISTn(message string) (responses []string) {
-	parts := strings.Split(message, " ")
-	if len(parts) != 2 {
-		err := fmt.Errorf("invalid message")
-		log.Printf("Error handleLISTn(): %v", err)
-		return []string{"-ERR"}
+// size returns the size of the email as sent to the client. If the headers are downgraded, they are read
+// once per session to add the difference to the size reported by the provider.
+func (handler *pop3Handler) size(number int, email *provider.Email) (size int64, err error) {
+	if !handler.downgrading() {
+		return email.Size, nil
 	}
-	number, err := strconv.Atoi(parts[1])
+	if delta, exists := handler.cache.downgradeDeltas[number]; exists {
+		return email.Size + delta, nil
+	}
+	reader, err := handler.topReader(number)
 	if err != nil {
-		log.Printf("Error handleLISTn(): %v", err)
-		return []string{"-ERR"}
+		return 0, err
 	}
-	email, err := handler.cache.provider.GetEmail(number, handler.cache.dele)
+	defer reader.Close()
+	delta, err := provider.DowngradeDelta(reader)
 	if err != nil {
-		log.Printf("Error handler.cache.provider.GetEmail(): %v", err)
-		return []string{"-ERR"}
+		return 0, err
+	}
+	if handler.cache.downgradeDeltas == nil {
+		handler.cache.downgradeDeltas = make(map[int]int64)
 	}
-	return []string{fmt.Sprintf("+OK %v %v", number, email.Size)}
+	handler.cache.downgradeDeltas[number] = delta
+	return email.Size + delta, nil
 }
 
-func (handler *pop3Handler) handleTOP(message string) (responses []string) {
-	parts := strings.Split(message, " ")
-	if len(parts) != 3 {
-		err := fmt.Errorf("invalid message")
-		log.Printf("Error handleTOP(): %v", err)
-		return []string{"-ERR"}
+// listUnsizedEmails lists the emails without computing their exact sizes if the provider supports it.
+func (handler *pop3Handler) listUnsizedEmails() (emails map[int]*provider.Email, err error) {
+	if unsizedProvider, ok := handler.cache.provider.(provider.UnsizedProvider); ok {
+		return unsizedProvider.ListUnsizedEmails(handler.cache.dele)
+	}
+	return handler.cache.provider.ListEmails(handler.cache.dele)
+}
+
+// getUnsizedEmail returns the email without computing its exact size if the provider supports it.
+func (handler *pop3Handler) getUnsizedEmail(number int) (email *provider.Email, err error) {
+	if unsizedProvider, ok := handler.cache.provider.(provider.UnsizedProvider); ok {
+		return unsizedProvider.GetUnsizedEmail(number, handler.cache.dele)
 	}
-	number, err := strconv.Atoi(parts[1])
+	return handler.cache.provider.GetEmail(number, handler.cache.dele)
+}
+
+func (handler *pop3Handler) handleUIDL(args []string) (response string) {
+	if len(args) == 1 {
+		number, err := handler.parseMessageNumber(args[0])
+		if err != nil {
+			log.Printf("Error handleUIDL(): %v", err)
+			return handler.errorResponse(err)
+		}
+		email, err := handler.getUnsizedEmail(number)
+		if err != nil {
+			log.Printf("Error handler.getUnsizedEmail(): %v", err)
+			return handler.errorResponse(err)
+		}
+		return fmt.Sprintf("+OK %v %v", number, email.ID)
+	}
+	emails, err := handler.listUnsizedEmails()
 	if err != nil {
-		log.Printf("Error handleTOP(): %v", err)
-		return []string{"-ERR"}
+		log.Printf("Error handler.listUnsizedEmails(): %v", err)
+		return handler.errorResponse(err)
 	}
-	x, err := strconv.Atoi(parts[2])
+	var lines []string
+	for _, number := range provider.GetSortedMailNumbers(emails) {
+		lines = append(lines, fmt.Sprintf("%v %v", number, emails[number].ID))
+	}
+	return handler.multiLine("+OK", lines)
+}
+
+func (handler *pop3Handler) handleLIST(args []string) (response string) {
+	if len(args) == 1 {
+		number, err := handler.parseMessageNumber(args[0])
+		if err != nil {
+			log.Printf("Error handleLIST(): %v", err)
+			return handler.errorResponse(err)
+		}
+		email, err := handler.cache.provider.GetEmail(number, handler.cache.dele)
+		if err != nil {
+			log.Printf("Error handler.cache.provider.GetEmail(): %v", err)
+			return handler.errorResponse(err)
+		}
+		size, err := handler.size(number, email)
+		if err != nil {
+			log.Printf("Error handler.size(): %v", err)
+			return handler.errorResponse(err)
+		}
+		return fmt.Sprintf("+OK %v %v", number, size)
+	}
+	emails, err := handler.cache.provider.ListEmails(handler.cache.dele)
 	if err != nil {
-		log.Printf("Error handleTOP(): %v", err)
-		return []string{"-ERR"}
+		log.Printf("Error handler.cache.provider.ListEmails(): %v", err)
+		return handler.errorResponse(err)
 	}
-	payload, err := handler.cache.provider.GetEmailPayload(number, handler.cache.dele)
+	var lines []string
+	for _, number := range provider.GetSortedMailNumbers(emails) {
+		size, err := handler.size(number, emails[number])
+		if err != nil {
+			log.Printf("Error handler.size(): %v", err)
+			return handler.errorResponse(err)
+		}
+		lines = append(lines, fmt.Sprintf("%v %v", number, size))
+	}
+	return handler.multiLine("+OK", lines)
+}
+
+func (handler *pop3Handler) handleTOP(args []string) (response string) {
+	number, err := handler.parseMessageNumber(args[0])
 	if err != nil {
-		log.Printf("Error handler.cache.provider.GetEmailPayload(): %v", err)
-		return []string{"-ERR"}
+		log.Printf("Error handleTOP(): %v", err)
+		return handler.errorResponse(err)
 	}
-	lines, err := payload.ParseHeaders(x)
+	x, err := parseNumber(args[1])
 	if err != nil {
-		log.Printf("Error payload.ParseHeaders(): %v", err)
-		return []string{"-ERR"}
+		log.Printf("Error handleTOP(): %v", err)
+		return handler.errorResponse(err)
 	}
-	responses = append(responses, "+OK")
-	for _, line := range lines {
-		responses = append(responses, line)
+	reader, err := handler.topReader(number)
+	if err != nil {
+		log.Printf("Error handler.topReader(): %v", err)
+		return handler.errorResponse(err)
 	}
-	responses = append(responses, ".")
-	return responses
+	handler.body = &multiLineBody{reader: handler.downgrade(reader), bodyLines: x}
+	return "+OK"
 }
 
-func (handler *pop3Handler) handleRETR(message string) (responses []string) {
-	parts := strings.Split(message, " ")
-	if len(parts) != 2 {
-		err := fmt.Errorf("invalid message")
-		log.Printf("Error handleRETR(): %v", err)
-		return []string{"-ERR"}
+// topReader opens the email for reading its headers, using ranged reads if the provider supports them.
+func (handler *pop3Handler) topReader(number int) (reader io.ReadCloser, err error) {
+	if topProvider, ok := handler.cache.provider.(provider.TopProvider); ok {
+		return topProvider.GetEmailTopReader(number, handler.cache.dele)
 	}
-	number, err := strconv.Atoi(parts[1])
+	return handler.cache.provider.GetEmailReader(number, handler.cache.dele)
+}
+
+func (handler *pop3Handler) handleRETR(args []string) (response string) {
+	number, err := handler.parseMessageNumber(args[0])
 	if err != nil {
 		log.Printf("Error handleRETR(): %v", err)
-		return []string{"-ERR"}
+		return handler.errorResponse(err)
 	}
-	payload, err := handler.cache.provider.GetEmailPayload(number, handler.cache.dele)
+	reader, err := handler.cache.provider.GetEmailReader(number, handler.cache.dele)
 	if err != nil {
-		log.Printf("Error handler.cache.provider.GetEmailPayload(): %v", err)
-		return []string{"-ERR"}
+		log.Printf("Error handler.cache.provider.GetEmailReader(): %v", err)
+		return handler.errorResponse(err)
 	}
-	lines, err := payload.ParseAll()
-	if err != nil {
-		log.Printf("Error payload.ParseAll(): %v", err)
-		return []string{"-ERR"}
+	handler.body = &multiLineBody{reader: handler.downgrade(reader), bodyLines: -1}
+	return "+OK"
+}
+
+// downgrading reports whether the headers of the emails are downgraded for the client.
+func (handler *pop3Handler) downgrading() bool {
+	return handler.options.DowngradeHeaders && !handler.utf8
+}
+
+func (handler *pop3Handler) downgrade(reader io.ReadCloser) io.ReadCloser {
+	if !handler.downgrading() {
+		return reader
 	}
-	responses = append(responses, "+OK")
-	for _, line := range lines {
-		responses = append(responses, line)
+	return struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: provider.NewHeaderDowngrader(reader),
+		Closer: reader,
 	}
-	responses = append(responses, ".")
-	return responses
 }
 
-func (handler *pop3Handler) handleDELE(message string) (responses []string) {
-	parts := strings.Split(message, " ")
-	if len(parts) != 2 {
-		err := fmt.Errorf("invalid message")
-		log.Printf("Error handleDELE(): %v", err)
-		return []string{"-ERR"}
-	}
-	number, err := strconv.Atoi(parts[1])
+func (handler *pop3Handler) handleDELE(args []string) (response string) {
+	number, err := handler.parseMessageNumber(args[0])
 	if err != nil {
 		log.Printf("Error handleDELE(): %v", err)
-		return []string{"-ERR"}
+		return handler.errorResponse(err)
+	}
+	if _, err := handler.getUnsizedEmail(number); err != nil {
+		log.Printf("Error handler.getUnsizedEmail(): %v", err)
+		return handler.errorResponse(err)
 	}
 	handler.cache.dele = append(handler.cache.dele, number)
-	return []string{"+OK"}
+	return "+OK"
 }
 
-func (handler *pop3Handler) handleQUIT() (responses []string) {
-	for _, number := range handler.cache.dele {
-		err := handler.cache.provider.DeleteEmail(number)
-		if err != nil {
-			log.Printf("Error handleQUIT(): %v", err)
-			return []string{"-ERR"}
+func (handler *pop3Handler) handleNOOP(args []string) (response string) {
+	return "+OK"
+}
+
+func (handler *pop3Handler) handleRSET(args []string) (response string) {
+	handler.cache.dele = nil
+	return "+OK"
+}
+
+// handleQUIT enters the UPDATE state if the client is authenticated and removes all messages marked as deleted.
+func (handler *pop3Handler) handleQUIT(args []string) (response string) {
+	handler.action = ActionQuit
+	if handler.state != stateTransaction {
+		return "+OK"
+	}
+	handler.state = stateUpdate
+	if len(handler.cache.dele) == 0 {
+		return "+OK"
+	}
+	err := handler.cache.provider.DeleteEmails(handler.cache.dele)
+	if err != nil {
+		log.Printf("Error handler.cache.provider.DeleteEmails(): %v", err)
+		// The IDs of the emails that have not been removed are logged only as they may exceed the line length limit.
+		// Source: https://www.ietf.org/rfc/rfc2449.txt
+		var deleteErr *provider.DeleteError
+		if errors.As(err, &deleteErr) {
+			return handler.errorResponse(errNotRemoved)
 		}
+		return handler.errorResponse(err)
 	}
-	return []string{"+OK"}
+	return "+OK"
 }
@@ -0,0 +1,908 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/markushinz/aws-ses-pop3-server/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubProvider struct {
+	emails  []provider.Email
+	deleted []int
+	// failing lists the numbers of the emails that cannot be deleted.
+	failing map[int]bool
+}
+
+var _ provider.Provider = &stubProvider{}
+
+func newStubProvider(payloads ...string) *stubProvider {
+	stub := &stubProvider{}
+	for index, payload := range payloads {
+		emailPayload := provider.EmailPayload(payload)
+		stub.emails = append(stub.emails, provider.Email{
+			ID:      fmt.Sprintf("id%v", index+1),
+			Size:    int64(len(payload)),
+			Payload: &emailPayload,
+		})
+	}
+	return stub
+}
+
+func (stub *stubProvider) ListEmails(notNumbers []int) (emails map[int]*provider.Email, err error) {
+	emails = make(map[int]*provider.Email)
+	for index := range stub.emails {
+		emails[index+1] = &stub.emails[index]
+	}
+	for _, notNumber := range notNumbers {
+		delete(emails, notNumber)
+	}
+	return emails, nil
+}
+
+func (stub *stubProvider) GetEmail(number int, notNumbers []int) (email *provider.Email, err error) {
+	emails, _ := stub.ListEmails(notNumbers)
+	if email, exists := emails[number]; exists {
+		return email, nil
+	}
+	return nil, fmt.Errorf("%w: %v does not exist", provider.ErrNoSuchEmail, number)
+}
+
+func (stub *stubProvider) GetEmailReader(number int, notNumbers []int) (reader io.ReadCloser, err error) {
+	email, err := stub.GetEmail(number, notNumbers)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(*email.Payload)), nil
+}
+
+func (stub *stubProvider) DeleteEmails(numbers []int) (err error) {
+	var failedIDs []string
+	for _, number := range numbers {
+		if stub.failing[number] {
+			failedIDs = append(failedIDs, stub.emails[number-1].ID)
+			continue
+		}
+		stub.deleted = append(stub.deleted, number)
+	}
+	if len(failedIDs) > 0 {
+		return &provider.DeleteError{IDs: failedIDs, Err: errors.New("AccessDenied")}
+	}
+	return nil
+}
+
+func newStubProviderCreator(stub *stubProvider) provider.ProviderCreator {
+	return func(user, password string) (provider.Provider, error) {
+		if user != "user" || password != "pass word" {
+			return nil, fmt.Errorf("%w: %v", provider.ErrAuth, user)
+		}
+		return stub, nil
+	}
+}
+
+type step struct {
+	message    string
+	want       []string
+	wantAction Action
+}
+
+// runSteps drives handler through Handle and compares every response line with the expected one.
+func runSteps(t *testing.T, handler Handler, steps []step) {
+	t.Helper()
+	for _, step := range steps {
+		var buf bytes.Buffer
+		action, err := handler.Handle(step.message, &buf)
+		require.NoError(t, err, step.message)
+		responses := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+		assert.EqualValues(t, step.want, responses, step.message)
+		assert.EqualValues(t, step.wantAction, action, step.message)
+	}
+}
+
+var login = []step{
+	{message: "USER user", want: []string{"+OK"}},
+	{message: "PASS pass word", want: []string{"+OK"}},
+}
+
+func TestPOP3HandlerConformance(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		steps       []step
+		wantDeleted []int
+	}{
+		{
+			name: "USER PASS",
+			steps: append(login,
+				step{message: "STAT", want: []string{"+OK 2 14"}},
+			),
+		},
+		{
+			name: "case-insensitive keywords",
+			steps: []step{
+				{message: "user user", want: []string{"+OK"}},
+				{message: "Pass pass word", want: []string{"+OK"}},
+				{message: "stat", want: []string{"+OK 2 14"}},
+				{message: "LiSt 2", want: []string{"+OK 2 7"}},
+			},
+		},
+		{
+			name: "PASS without USER",
+			steps: []step{
+				{message: "PASS pass word", want: []string{"-ERR command not valid in this state"}},
+				{message: "STAT", want: []string{"-ERR command not valid in this state"}},
+			},
+		},
+		{
+			name: "PASS not directly after USER",
+			steps: []step{
+				{message: "USER user", want: []string{"+OK"}},
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "."}},
+				{message: "PASS pass word", want: []string{"-ERR command not valid in this state"}},
+			},
+		},
+		{
+			name: "wrong password",
+			steps: []step{
+				{message: "USER user", want: []string{"+OK"}},
+				{message: "PASS password", want: []string{"-ERR [AUTH] invalid credentials"}},
+				{message: "PASS pass word", want: []string{"-ERR command not valid in this state"}},
+				{message: "USER user", want: []string{"+OK"}},
+				{message: "PASS pass word", want: []string{"+OK"}},
+			},
+		},
+		{
+			name: "authorization commands after login",
+			steps: append(login,
+				step{message: "USER user", want: []string{"-ERR command not valid in this state"}},
+				step{message: "PASS pass word", want: []string{"-ERR command not valid in this state"}},
+				step{message: "APOP user digest", want: []string{"-ERR command not valid in this state"}},
+				step{message: "AUTH PLAIN", want: []string{"-ERR command not valid in this state"}},
+				step{message: "STLS", want: []string{"-ERR command not valid in this state"}},
+			),
+		},
+		{
+			name: "transaction commands before login",
+			steps: []step{
+				{message: "STAT", want: []string{"-ERR command not valid in this state"}},
+				{message: "LIST", want: []string{"-ERR command not valid in this state"}},
+				{message: "UIDL", want: []string{"-ERR command not valid in this state"}},
+				{message: "TOP 1 0", want: []string{"-ERR command not valid in this state"}},
+				{message: "RETR 1", want: []string{"-ERR command not valid in this state"}},
+				{message: "DELE 1", want: []string{"-ERR command not valid in this state"}},
+				{message: "NOOP", want: []string{"-ERR command not valid in this state"}},
+				{message: "RSET", want: []string{"-ERR command not valid in this state"}},
+			},
+		},
+		{
+			name: "unknown command",
+			steps: []step{
+				{message: "HELO", want: []string{"-ERR unknown command"}},
+				{message: "", want: []string{"-ERR unknown command"}},
+			},
+		},
+		{
+			name: "argument validation",
+			steps: append(login,
+				step{message: "STAT 1", want: []string{"-ERR invalid message"}},
+				step{message: "LIST 1 2", want: []string{"-ERR invalid message"}},
+				step{message: "LIST +1", want: []string{"-ERR invalid message"}},
+				step{message: "LIST -1", want: []string{"-ERR invalid message"}},
+				step{message: "LIST 1 ", want: []string{"-ERR invalid message"}},
+				step{message: "LIST  1", want: []string{"-ERR invalid message"}},
+				step{message: "LIST 0", want: []string{"-ERR no such message"}},
+				step{message: "RETR", want: []string{"-ERR invalid message"}},
+				step{message: "RETR one", want: []string{"-ERR invalid message"}},
+				step{message: "TOP 1", want: []string{"-ERR invalid message"}},
+				step{message: "TOP 1 -1", want: []string{"-ERR invalid message"}},
+				step{message: "DELE", want: []string{"-ERR invalid message"}},
+				step{message: "NOOP 1", want: []string{"-ERR invalid message"}},
+				step{message: "QUIT now", want: []string{"-ERR invalid message"}},
+			),
+		},
+		{
+			name: "USER argument validation",
+			steps: []step{
+				{message: "USER", want: []string{"-ERR invalid message"}},
+				{message: "USER ", want: []string{"-ERR invalid message"}},
+				{message: "USER user name", want: []string{"-ERR invalid message"}},
+				{message: "APOP user", want: []string{"-ERR invalid message"}},
+			},
+		},
+		{
+			name: "transaction",
+			steps: append(login,
+				step{message: "LIST", want: []string{"+OK", "1 7", "2 7", "."}},
+				step{message: "UIDL", want: []string{"+OK", "1 id1", "2 id2", "."}},
+				step{message: "UIDL 2", want: []string{"+OK 2 id2"}},
+				step{message: "RETR 1", want: []string{"+OK", "a: b", "", "c", "."}},
+				step{message: "TOP 2 0", want: []string{"+OK", "d: e", "", "."}},
+				step{message: "NOOP", want: []string{"+OK"}},
+				step{message: "LIST 3", want: []string{"-ERR no such message"}},
+			),
+		},
+		{
+			name: "QUIT in AUTHORIZATION",
+			steps: []step{
+				{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+			},
+		},
+		{
+			name: "QUIT enters UPDATE",
+			steps: append(login,
+				step{message: "DELE 2", want: []string{"+OK"}},
+				step{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+				step{message: "STAT", want: []string{"-ERR command not valid in this state"}},
+				step{message: "QUIT", want: []string{"-ERR command not valid in this state"}},
+			),
+			wantDeleted: []int{2},
+		},
+		{
+			name: "RSET",
+			steps: append(login,
+				step{message: "DELE 1", want: []string{"+OK"}},
+				step{message: "RSET", want: []string{"+OK"}},
+				step{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+			),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stub := newStubProvider("a: b\n\nc", "d: e\n\nf")
+			handler, _, err := newPOP3Handler(newStubProviderCreator(stub), POP3Options{}, TLSUnavailable)
+			require.NoError(t, err)
+			runSteps(t, handler, tt.steps)
+			assert.EqualValues(t, tt.wantDeleted, stub.deleted)
+		})
+	}
+}
+
+func TestPOP3HandlerDELE(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		steps       []step
+		wantDeleted []int
+	}{
+		{
+			name: "DELE",
+			steps: append(login,
+				step{message: "DELE 1", want: []string{"+OK"}},
+				step{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+			),
+			wantDeleted: []int{1},
+		},
+		{
+			name: "DELE twice",
+			steps: append(login,
+				step{message: "DELE 1", want: []string{"+OK"}},
+				step{message: "DELE 1", want: []string{"-ERR message already deleted"}},
+				step{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+			),
+			wantDeleted: []int{1},
+		},
+		{
+			name: "DELE out of range",
+			steps: append(login,
+				step{message: "DELE 3", want: []string{"-ERR no such message"}},
+				step{message: "DELE 999", want: []string{"-ERR no such message"}},
+				step{message: "DELE 0", want: []string{"-ERR no such message"}},
+				step{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+			),
+		},
+		{
+			name: "STAT honours marks",
+			steps: append(login,
+				step{message: "DELE 1", want: []string{"+OK"}},
+				step{message: "STAT", want: []string{"+OK 1 7"}},
+			),
+		},
+		{
+			name: "LIST honours marks",
+			steps: append(login,
+				step{message: "DELE 1", want: []string{"+OK"}},
+				step{message: "LIST", want: []string{"+OK", "2 7", "."}},
+				step{message: "LIST 1", want: []string{"-ERR message already deleted"}},
+				step{message: "LIST 2", want: []string{"+OK 2 7"}},
+			),
+		},
+		{
+			name: "UIDL honours marks",
+			steps: append(login,
+				step{message: "DELE 2", want: []string{"+OK"}},
+				step{message: "UIDL", want: []string{"+OK", "1 id1", "."}},
+				step{message: "UIDL 2", want: []string{"-ERR message already deleted"}},
+			),
+		},
+		{
+			name: "RETR and TOP honour marks",
+			steps: append(login,
+				step{message: "DELE 1", want: []string{"+OK"}},
+				step{message: "RETR 1", want: []string{"-ERR message already deleted"}},
+				step{message: "TOP 1 0", want: []string{"-ERR message already deleted"}},
+				step{message: "RETR 2", want: []string{"+OK", "d: e", "", "f", "."}},
+			),
+		},
+		{
+			name: "RSET unmarks",
+			steps: append(login,
+				step{message: "DELE 1", want: []string{"+OK"}},
+				step{message: "DELE 2", want: []string{"+OK"}},
+				step{message: "STAT", want: []string{"+OK 0 0"}},
+				step{message: "RSET", want: []string{"+OK"}},
+				step{message: "STAT", want: []string{"+OK 2 14"}},
+				step{message: "DELE 2", want: []string{"+OK"}},
+				step{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+			),
+			wantDeleted: []int{2},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stub := newStubProvider("a: b\n\nc", "d: e\n\nf")
+			handler, _, err := newPOP3Handler(newStubProviderCreator(stub), POP3Options{}, TLSUnavailable)
+			require.NoError(t, err)
+			runSteps(t, handler, tt.steps)
+			assert.EqualValues(t, tt.wantDeleted, stub.deleted)
+		})
+	}
+}
+
+func TestPOP3HandlerQUIT(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		failing     map[int]bool
+		steps       []step
+		wantDeleted []int
+	}{
+		{
+			name: "all deleted",
+			steps: append(login,
+				step{message: "DELE 1", want: []string{"+OK"}},
+				step{message: "DELE 2", want: []string{"+OK"}},
+				step{message: "DELE 3", want: []string{"+OK"}},
+				step{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+			),
+			wantDeleted: []int{1, 2, 3},
+		},
+		{
+			name:    "partial failure",
+			failing: map[int]bool{1: true, 3: true},
+			steps: append(login,
+				step{message: "DELE 1", want: []string{"+OK"}},
+				step{message: "DELE 2", want: []string{"+OK"}},
+				step{message: "DELE 3", want: []string{"+OK"}},
+				step{message: "QUIT", want: []string{"-ERR [SYS/TEMP] some deleted messages not removed"}, wantAction: ActionQuit},
+			),
+			wantDeleted: []int{2},
+		},
+		{
+			name:    "failure of unmarked message",
+			failing: map[int]bool{1: true},
+			steps: append(login,
+				step{message: "DELE 2", want: []string{"+OK"}},
+				step{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+			),
+			wantDeleted: []int{2},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stub := newStubProvider("a", "b", "c")
+			stub.failing = tt.failing
+			handler, _, err := newPOP3Handler(newStubProviderCreator(stub), POP3Options{}, TLSUnavailable)
+			require.NoError(t, err)
+			runSteps(t, handler, tt.steps)
+			assert.EqualValues(t, tt.wantDeleted, stub.deleted)
+		})
+	}
+}
+
+func TestPOP3HandlerTimeouts(t *testing.T) {
+	t.Parallel()
+	options := POP3Options{
+		PreAuthTimeout:    time.Minute,
+		AutologoutTimeout: 10 * time.Minute,
+		WriteTimeout:      30 * time.Second,
+	}
+	handler, _, err := newPOP3Handler(newStubProviderCreator(newStubProvider()), options, TLSUnavailable)
+	require.NoError(t, err)
+
+	read, write := handler.Timeouts()
+	assert.EqualValues(t, time.Minute, read)
+	assert.EqualValues(t, 30*time.Second, write)
+
+	runSteps(t, handler, login)
+	read, write = handler.Timeouts()
+	assert.EqualValues(t, 10*time.Minute, read)
+	assert.EqualValues(t, 30*time.Second, write)
+}
+
+func TestPOP3HandlerRETR(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "RETR",
+			steps: append(login,
+				step{message: "RETR 1", want: []string{"+OK", "Subject: dots", "", "..", "..hidden", "last line", "."}},
+			),
+		},
+		{
+			name: "TOP",
+			steps: append(login,
+				step{message: "TOP 1 0", want: []string{"+OK", "Subject: dots", "", "."}},
+				step{message: "TOP 1 2", want: []string{"+OK", "Subject: dots", "", "..", "..hidden", "."}},
+				step{message: "TOP 1 100", want: []string{"+OK", "Subject: dots", "", "..", "..hidden", "last line", "."}},
+			),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stub := newStubProvider("Subject: dots\n\n.\r\n.hidden\nlast line")
+			handler, _, err := newPOP3Handler(newStubProviderCreator(stub), POP3Options{}, TLSUnavailable)
+			require.NoError(t, err)
+			runSteps(t, handler, tt.steps)
+		})
+	}
+}
+
+type failingProvider struct {
+	*stubProvider
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (n int, err error) {
+	return 0, provider.ErrTemporary
+}
+
+func (provider failingProvider) GetEmailReader(number int, notNumbers []int) (reader io.ReadCloser, err error) {
+	return io.NopCloser(io.MultiReader(strings.NewReader("Subject: partial\n"), failingReader{})), nil
+}
+
+func TestPOP3HandlerRETRReadError(t *testing.T) {
+	t.Parallel()
+	stub := failingProvider{stubProvider: newStubProvider("a")}
+	handler, _, err := newPOP3Handler(func(user, password string) (provider.Provider, error) {
+		return stub, nil
+	}, POP3Options{}, TLSUnavailable)
+	require.NoError(t, err)
+	runSteps(t, handler, login)
+
+	var buf bytes.Buffer
+	_, err = handler.Handle("RETR 1", &buf)
+	assert.ErrorIs(t, err, provider.ErrTemporary)
+	assert.False(t, strings.HasSuffix(buf.String(), "\r\n.\r\n"))
+}
+
+func TestPOP3HandlerUTF8(t *testing.T) {
+	t.Parallel()
+	const payload = "Subject: Grüße\nTo: user\n\nHallo Wörld"
+	tests := []struct {
+		name    string
+		options POP3Options
+		steps   []step
+	}{
+		{
+			name: "USER with UTF-8",
+			steps: []step{
+				{message: "UTF8", want: []string{"+OK"}},
+				{message: "USER üser", want: []string{"+OK"}},
+				{message: "PASS pass word", want: []string{"+OK"}},
+				{message: "UTF8", want: []string{"-ERR command not valid in this state"}},
+			},
+		},
+		{
+			name: "USER with invalid UTF-8",
+			steps: []step{
+				{message: "USER \xff", want: []string{"-ERR invalid message"}},
+			},
+		},
+		{
+			name: "without downgrade",
+			steps: append(login,
+				step{message: "RETR 1", want: []string{"+OK", "Subject: Grüße", "To: user", "", "Hallo Wörld", "."}},
+				step{message: "LIST 1", want: []string{"+OK 1 39"}},
+			),
+		},
+		{
+			name:    "downgrade",
+			options: POP3Options{DowngradeHeaders: true},
+			steps: append(login,
+				step{message: "RETR 1", want: []string{"+OK", "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=", "To: user", "", "Hallo Wörld", "."}},
+				step{message: "TOP 1 0", want: []string{"+OK", "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=", "To: user", "", "."}},
+				step{message: "STAT", want: []string{"+OK 1 59"}},
+				step{message: "LIST", want: []string{"+OK", "1 59", "."}},
+				step{message: "LIST 1", want: []string{"+OK 1 59"}},
+			),
+		},
+		{
+			name:    "downgrade after UTF8",
+			options: POP3Options{DowngradeHeaders: true},
+			steps: append([]step{{message: "UTF8", want: []string{"+OK"}}}, append(login,
+				step{message: "RETR 1", want: []string{"+OK", "Subject: Grüße", "To: user", "", "Hallo Wörld", "."}},
+			)...),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stub := newStubProvider(payload)
+			handler, _, err := newPOP3Handler(func(user, password string) (provider.Provider, error) {
+				if (user != "user" && user != "üser") || password != "pass word" {
+					return nil, fmt.Errorf("%w: %v", provider.ErrAuth, user)
+				}
+				return stub, nil
+			}, tt.options, TLSUnavailable)
+			require.NoError(t, err)
+			runSteps(t, handler, tt.steps)
+		})
+	}
+}
+
+func TestPOP3HandlerLANG(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "list",
+			steps: []step{
+				{message: "LANG", want: []string{"+OK Language listing follows", "en English", "de Deutsch", "."}},
+			},
+		},
+		{
+			name: "change",
+			steps: []step{
+				{message: "LANG de-DE", want: []string{"+OK de Sprache geändert"}},
+				{message: "PASS pass word", want: []string{"-ERR Befehl in diesem Zustand nicht zulässig"}},
+				{message: "USER user", want: []string{"+OK"}},
+				{message: "PASS wrong", want: []string{"-ERR [AUTH] ungültige Anmeldedaten"}},
+				{message: "LANG fr", want: []string{"-ERR ungültige Sprache"}},
+				{message: "LANG", want: []string{"+OK Liste der Sprachen folgt", "en English", "de Deutsch", "."}},
+				{message: "LANG *", want: []string{"+OK en Language changed"}},
+				{message: "FOO", want: []string{"-ERR unknown command"}},
+			},
+		},
+		{
+			name: "TRANSACTION",
+			steps: append(login,
+				step{message: "LANG de", want: []string{"+OK de Sprache geändert"}},
+				step{message: "RETR 3", want: []string{"-ERR Nachricht existiert nicht"}},
+			),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			handler, _, err := newPOP3Handler(newStubProviderCreator(newStubProvider("a")), POP3Options{}, TLSUnavailable)
+			require.NoError(t, err)
+			runSteps(t, handler, tt.steps)
+		})
+	}
+}
+
+func TestPOP3HandlerSTLSResetsState(t *testing.T) {
+	t.Parallel()
+	handler, _, err := newPOP3Handler(newStubProviderCreator(newStubProvider("Subject: Grüße\n\n")), POP3Options{DowngradeHeaders: true}, TLSAvailable)
+	require.NoError(t, err)
+	runSteps(t, handler, append([]step{
+		{message: "LANG de", want: []string{"+OK de Sprache geändert"}},
+		{message: "UTF8", want: []string{"+OK"}},
+		{message: "STLS", want: []string{"+OK"}, wantAction: ActionSTLS},
+		{message: "FOO", want: []string{"-ERR unknown command"}},
+	}, append(login,
+		step{message: "RETR 1", want: []string{"+OK", "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=", "", "."}},
+	)...))
+}
+
+type policyProvider struct {
+	*stubProvider
+	policy provider.Policy
+}
+
+func (provider policyProvider) Policy() provider.Policy {
+	return provider.policy
+}
+
+func TestPOP3HandlerPolicy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		options POP3Options
+		policy  provider.Policy
+		steps   []step
+	}{
+		{
+			name: "without policy",
+			steps: []step{
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "."}},
+			},
+		},
+		{
+			name:    "defaults",
+			options: POP3Options{Policy: provider.Policy{Expire: "30", LoginDelay: 900}},
+			steps: []step{
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "EXPIRE 30", "LOGIN-DELAY 900", "."}},
+				{message: "USER defaults", want: []string{"+OK"}},
+				{message: "PASS pass word", want: []string{"+OK"}},
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "EXPIRE 30", "LOGIN-DELAY 900", "."}},
+			},
+		},
+		{
+			name:    "per user",
+			options: POP3Options{Policy: provider.Policy{Expire: "30", LoginDelay: 900}, PolicyPerUser: true},
+			policy:  provider.Policy{Expire: "NEVER"},
+			steps: []step{
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "EXPIRE 30 USER", "LOGIN-DELAY 900 USER", "."}},
+				{message: "USER per-user", want: []string{"+OK"}},
+				{message: "PASS pass word", want: []string{"+OK"}},
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "EXPIRE NEVER", "LOGIN-DELAY 900", "."}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stub := policyProvider{stubProvider: newStubProvider("a"), policy: tt.policy}
+			handler, _, err := newPOP3Handler(func(user, password string) (provider.Provider, error) {
+				return stub, nil
+			}, tt.options, TLSUnavailable)
+			require.NoError(t, err)
+			runSteps(t, handler, tt.steps)
+		})
+	}
+}
+
+func TestPOP3HandlerLoginDelay(t *testing.T) {
+	t.Parallel()
+	stub := policyProvider{stubProvider: newStubProvider("a"), policy: provider.Policy{LoginDelay: 900}}
+	creator := func(user, password string) (provider.Provider, error) {
+		return stub, nil
+	}
+	steps := []step{
+		{message: "USER login-delay", want: []string{"+OK"}},
+		{message: "PASS pass word", want: []string{"+OK"}},
+	}
+	options := POP3Options{Logins: NewLoginTable()}
+	handler, _, err := newPOP3Handler(creator, options, TLSUnavailable)
+	require.NoError(t, err)
+	runSteps(t, handler, steps)
+
+	handler, _, err = newPOP3Handler(creator, options, TLSUnavailable)
+	require.NoError(t, err)
+	runSteps(t, handler, []step{
+		{message: "USER login-delay", want: []string{"+OK"}},
+		{message: "PASS pass word", want: []string{"-ERR [LOGIN-DELAY] minimum time between logins not yet elapsed"}},
+		{message: "USER other", want: []string{"+OK"}},
+		{message: "PASS pass word", want: []string{"+OK"}},
+	})
+}
+
+type identityProvider struct {
+	policyProvider
+	identity string
+}
+
+func (provider identityProvider) Identity() string {
+	return provider.identity
+}
+
+func TestPOP3HandlerLoginDelayIdentity(t *testing.T) {
+	t.Parallel()
+	options := POP3Options{Logins: NewLoginTable()}
+	creator := func(user, password string) (provider.Provider, error) {
+		return identityProvider{
+			policyProvider: policyProvider{stubProvider: newStubProvider("a"), policy: provider.Policy{LoginDelay: 900}},
+			identity:       password,
+		}, nil
+	}
+	handler, _, err := newPOP3Handler(creator, options, TLSUnavailable)
+	require.NoError(t, err)
+	runSteps(t, handler, []step{
+		{message: "USER victim", want: []string{"+OK"}},
+		{message: "PASS attacker", want: []string{"+OK"}},
+	})
+
+	// The delay applies to the verified identity instead of the user supplied by the client.
+	handler, _, err = newPOP3Handler(creator, options, TLSUnavailable)
+	require.NoError(t, err)
+	runSteps(t, handler, []step{
+		{message: "USER victim", want: []string{"+OK"}},
+		{message: "PASS victim", want: []string{"+OK"}},
+		{message: "QUIT", want: []string{"+OK"}, wantAction: ActionQuit},
+	})
+	handler, _, err = newPOP3Handler(creator, options, TLSUnavailable)
+	require.NoError(t, err)
+	runSteps(t, handler, []step{
+		{message: "USER other", want: []string{"+OK"}},
+		{message: "PASS attacker", want: []string{"-ERR [LOGIN-DELAY] minimum time between logins not yet elapsed"}},
+	})
+}
+
+// unsizedProvider counts the calls that compute the exact sizes of the emails.
+type unsizedProvider struct {
+	*stubProvider
+	sized int
+}
+
+func (provider *unsizedProvider) ListEmails(notNumbers []int) (emails map[int]*provider.Email, err error) {
+	provider.sized++
+	return provider.stubProvider.ListEmails(notNumbers)
+}
+
+func (provider *unsizedProvider) GetEmail(number int, notNumbers []int) (email *provider.Email, err error) {
+	provider.sized++
+	return provider.stubProvider.GetEmail(number, notNumbers)
+}
+
+func (provider *unsizedProvider) ListUnsizedEmails(notNumbers []int) (emails map[int]*provider.Email, err error) {
+	return provider.stubProvider.ListEmails(notNumbers)
+}
+
+func (provider *unsizedProvider) GetUnsizedEmail(number int, notNumbers []int) (email *provider.Email, err error) {
+	return provider.stubProvider.GetEmail(number, notNumbers)
+}
+
+func TestPOP3HandlerUnsizedProvider(t *testing.T) {
+	t.Parallel()
+	stub := &unsizedProvider{stubProvider: newStubProvider("a", "b")}
+	handler, _, err := newPOP3Handler(func(user, password string) (provider.Provider, error) {
+		return stub, nil
+	}, POP3Options{}, TLSUnavailable)
+	require.NoError(t, err)
+	runSteps(t, handler, append(login,
+		step{message: "UIDL", want: []string{"+OK", "1 id1", "2 id2", "."}},
+		step{message: "UIDL 2", want: []string{"+OK 2 id2"}},
+		step{message: "DELE 1", want: []string{"+OK"}},
+		step{message: "DELE 3", want: []string{"-ERR no such message"}},
+	))
+	assert.EqualValues(t, 0, stub.sized)
+	runSteps(t, handler, []step{
+		{message: "LIST 2", want: []string{"+OK 2 1"}},
+	})
+	assert.EqualValues(t, 1, stub.sized)
+}
+
+type capabilityProvider struct {
+	*stubProvider
+	capabilities []string
+}
+
+func (provider capabilityProvider) Capabilities() []string {
+	return provider.capabilities
+}
+
+func TestPOP3HandlerCAPA(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name         string
+		options      POP3Options
+		tlsState     TLSState
+		capabilities []string
+		steps        []step
+	}{
+		{
+			name:     "STLS and SASL",
+			options:  POP3Options{SASLMechanisms: []string{"PLAIN"}, Implementation: "aws-ses-pop3-server 1.0.0"},
+			tlsState: TLSAvailable,
+			steps: []step{
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "SASL PLAIN", "STLS", "IMPLEMENTATION aws-ses-pop3-server 1.0.0", "."}},
+			},
+		},
+		{
+			name:     "STLS and SASL after login",
+			options:  POP3Options{SASLMechanisms: []string{"PLAIN"}, Implementation: "aws-ses-pop3-server 1.0.0"},
+			tlsState: TLSAvailable,
+			steps: append(login,
+				step{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "IMPLEMENTATION aws-ses-pop3-server 1.0.0", "."}},
+			),
+		},
+		{
+			name:     "plaintext authentication disabled",
+			options:  POP3Options{SASLMechanisms: []string{"PLAIN"}, DisablePlaintextAuth: true},
+			tlsState: TLSAvailable,
+			steps: []step{
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "STLS", "."}},
+			},
+		},
+		{
+			name:     "plaintext authentication disabled with TLS",
+			options:  POP3Options{SASLMechanisms: []string{"PLAIN"}, DisablePlaintextAuth: true},
+			tlsState: TLSActive,
+			steps: []step{
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "SASL PLAIN", "."}},
+			},
+		},
+		{
+			name:         "provider without TOP",
+			capabilities: []string{"UIDL"},
+			steps: append([]step{
+				{message: "CAPA", want: []string{"+OK", "TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "USER", "."}},
+			}, append(login,
+				step{message: "CAPA", want: []string{"+OK", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "UTF8 USER", "LANG", "."}},
+				step{message: "TOP 1 0", want: []string{"-ERR not supported"}},
+				step{message: "UIDL 1", want: []string{"+OK 1 id1"}},
+			)...),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stub := newStubProvider("a")
+			handler, _, err := newPOP3Handler(func(user, password string) (provider.Provider, error) {
+				if tt.capabilities == nil {
+					return stub, nil
+				}
+				return capabilityProvider{stubProvider: stub, capabilities: tt.capabilities}, nil
+			}, tt.options, tt.tlsState)
+			require.NoError(t, err)
+			runSteps(t, handler, tt.steps)
+		})
+	}
+}
+
+type topProvider struct {
+	*stubProvider
+	topReads int
+}
+
+func (provider *topProvider) GetEmailTopReader(number int, notNumbers []int) (reader io.ReadCloser, err error) {
+	provider.topReads++
+	return provider.GetEmailReader(number, notNumbers)
+}
+
+func TestPOP3HandlerTOPProvider(t *testing.T) {
+	t.Parallel()
+	stub := &topProvider{stubProvider: newStubProvider("Subject: top\n\nbody")}
+	handler, _, err := newPOP3Handler(func(user, password string) (provider.Provider, error) {
+		return stub, nil
+	}, POP3Options{}, TLSUnavailable)
+	require.NoError(t, err)
+	runSteps(t, handler, append(login,
+		step{message: "TOP 1 0", want: []string{"+OK", "Subject: top", "", "."}},
+		step{message: "RETR 1", want: []string{"+OK", "Subject: top", "", "body", "."}},
+		step{message: "TOP 2 0", want: []string{"-ERR no such message"}},
+	))
+	assert.EqualValues(t, 2, stub.topReads)
+}
@@ -0,0 +1,287 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/markushinz/aws-ses-pop3-server/pkg/provider"
+)
+
+// saslMechanism is the server side of a SASL exchange (RFC 4422).
+type saslMechanism interface {
+	// Start returns the initial challenge if the client did not send an initial response.
+	Start() (challenge []byte)
+	// Next processes a response of the client and returns either the next challenge or done.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// Credentials returns the credentials obtained during the exchange once done.
+	Credentials() (user, password string)
+}
+
+// saslFailureChallenger is implemented by mechanisms that send an error challenge
+// before the exchange is failed if the obtained credentials are rejected.
+type saslFailureChallenger interface {
+	FailureChallenge(err error) (challenge []byte)
+}
+
+type saslMechanismCreator func() saslMechanism
+
+var saslMechanisms = map[string]saslMechanismCreator{
+	"PLAIN":       newPlainMechanism,
+	"LOGIN":       newLoginMechanism,
+	"XOAUTH2":     newXOAuth2Mechanism,
+	"OAUTHBEARER": newOAuthBearerMechanism,
+}
+
+func decodeSASLResponse(response string) ([]byte, error) {
+	// A single "=" indicates an initial response containing zero-length data.
+	// Source: https://www.ietf.org/rfc/rfc5034.txt
+	if response == "=" {
+		return []byte{}, nil
+	}
+	return base64.StdEncoding.DecodeString(response)
+}
+
+func encodeSASLChallenge(challenge []byte) string {
+	return "+ " + base64.StdEncoding.EncodeToString(challenge)
+}
+
+type plainMechanism struct {
+	user     string
+	password string
+}
+
+func newPlainMechanism() saslMechanism {
+	return &plainMechanism{}
+}
+
+func (mechanism *plainMechanism) Start() (challenge []byte) {
+	return []byte{}
+}
+
+// Next expects a message of the form [authzid] NUL authcid NUL passwd.
+// Source: https://www.ietf.org/rfc/rfc4616.txt
+func (mechanism *plainMechanism) Next(response []byte) (challenge []byte, done bool, err error) {
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, fmt.Errorf("%w: PLAIN message", errInvalidMessage)
+	}
+	authzid, authcid, passwd := string(parts[0]), string(parts[1]), string(parts[2])
+	if authcid == "" || passwd == "" {
+		return nil, false, fmt.Errorf("%w: PLAIN message", errInvalidMessage)
+	}
+	if authzid != "" && authzid != authcid {
+		return nil, false, fmt.Errorf("%w: authorization identity does not match authentication identity", provider.ErrAuth)
+	}
+	mechanism.user = authcid
+	mechanism.password = passwd
+	return nil, true, nil
+}
+
+func (mechanism *plainMechanism) Credentials() (user, password string) {
+	return mechanism.user, mechanism.password
+}
+
+type loginMechanism struct {
+	user     *string
+	password string
+}
+
+func newLoginMechanism() saslMechanism {
+	return &loginMechanism{}
+}
+
+func (mechanism *loginMechanism) Start() (challenge []byte) {
+	return []byte("Username:")
+}
+
+// Next expects the user followed by the password. The mechanism is obsolete but still widely used.
+// Source: https://datatracker.ietf.org/doc/html/draft-murchison-sasl-login-00
+func (mechanism *loginMechanism) Next(response []byte) (challenge []byte, done bool, err error) {
+	if mechanism.user == nil {
+		user := string(response)
+		if user == "" {
+			return nil, false, fmt.Errorf("%w: LOGIN user", errInvalidMessage)
+		}
+		mechanism.user = &user
+		return []byte("Password:"), false, nil
+	}
+	mechanism.password = string(response)
+	if mechanism.password == "" {
+		return nil, false, fmt.Errorf("%w: LOGIN password", errInvalidMessage)
+	}
+	return nil, true, nil
+}
+
+func (mechanism *loginMechanism) Credentials() (user, password string) {
+	if mechanism.user == nil {
+		return "", mechanism.password
+	}
+	return *mechanism.user, mechanism.password
+}
+
+// saslFailure fails the exchange with the next response of the client.
+type saslFailure struct {
+	err error
+}
+
+func (mechanism *saslFailure) Start() (challenge []byte) {
+	return []byte{}
+}
+
+func (mechanism *saslFailure) Next(response []byte) (challenge []byte, done bool, err error) {
+	return nil, false, mechanism.err
+}
+
+func (mechanism *saslFailure) Credentials() (user, password string) {
+	return "", ""
+}
+
+// parseKVPairs parses key=value pairs that are separated and terminated by ^A.
+func parseKVPairs(message string) (pairs map[string]string, err error) {
+	if !strings.HasSuffix(message, "\x01\x01") {
+		return nil, fmt.Errorf("%w: missing terminating ^A^A", errInvalidMessage)
+	}
+	pairs = make(map[string]string)
+	for _, pair := range strings.Split(strings.TrimSuffix(message, "\x01\x01"), "\x01") {
+		if pair == "" {
+			continue
+		}
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("%w: key value pair %q", errInvalidMessage, pair)
+		}
+		pairs[key] = value
+	}
+	return pairs, nil
+}
+
+func parseBearerToken(auth string) (token string, err error) {
+	scheme, token, found := strings.Cut(auth, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", fmt.Errorf("%w: bearer token", errInvalidMessage)
+	}
+	return token, nil
+}
+
+type xOAuth2Mechanism struct {
+	user  string
+	token string
+}
+
+func newXOAuth2Mechanism() saslMechanism {
+	return &xOAuth2Mechanism{}
+}
+
+func (mechanism *xOAuth2Mechanism) Start() (challenge []byte) {
+	return []byte{}
+}
+
+// Next expects a message of the form user={user}^Aauth=Bearer {token}^A^A.
+// Source: https://developers.google.com/gmail/imap/xoauth2-protocol
+func (mechanism *xOAuth2Mechanism) Next(response []byte) (challenge []byte, done bool, err error) {
+	pairs, err := parseKVPairs(string(response))
+	if err != nil {
+		return nil, false, err
+	}
+	token, err := parseBearerToken(pairs["auth"])
+	if err != nil {
+		return nil, false, err
+	}
+	mechanism.user = pairs["user"]
+	mechanism.token = token
+	return nil, true, nil
+}
+
+func (mechanism *xOAuth2Mechanism) Credentials() (user, password string) {
+	return mechanism.user, mechanism.token
+}
+
+func (mechanism *xOAuth2Mechanism) FailureChallenge(err error) (challenge []byte) {
+	challenge, _ = json.Marshal(struct {
+		Status  string `json:"status"`
+		Schemes string `json:"schemes"`
+	}{
+		Status:  "401",
+		Schemes: "bearer",
+	})
+	return challenge
+}
+
+type oAuthBearerMechanism struct {
+	user  string
+	token string
+}
+
+func newOAuthBearerMechanism() saslMechanism {
+	return &oAuthBearerMechanism{}
+}
+
+func (mechanism *oAuthBearerMechanism) Start() (challenge []byte) {
+	return []byte{}
+}
+
+// Next expects a message of the form n,a={user},^Aauth=Bearer {token}^A^A.
+// Source: https://www.ietf.org/rfc/rfc7628.txt
+func (mechanism *oAuthBearerMechanism) Next(response []byte) (challenge []byte, done bool, err error) {
+	gs2Header, kvPairs, found := strings.Cut(string(response), "\x01")
+	if !found {
+		return nil, false, fmt.Errorf("%w: OAUTHBEARER message", errInvalidMessage)
+	}
+	parts := strings.Split(gs2Header, ",")
+	if len(parts) != 3 || parts[2] != "" {
+		return nil, false, fmt.Errorf("%w: GS2 header", errInvalidMessage)
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		return nil, false, fmt.Errorf("%w: channel binding", errUnsupported)
+	}
+	user := ""
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, fmt.Errorf("%w: GS2 header", errInvalidMessage)
+		}
+		user = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(strings.TrimPrefix(parts[1], "a="))
+	}
+	pairs, err := parseKVPairs(kvPairs)
+	if err != nil {
+		return nil, false, err
+	}
+	token, err := parseBearerToken(pairs["auth"])
+	if err != nil {
+		return nil, false, err
+	}
+	mechanism.user = user
+	mechanism.token = token
+	return nil, true, nil
+}
+
+func (mechanism *oAuthBearerMechanism) Credentials() (user, password string) {
+	return mechanism.user, mechanism.token
+}
+
+func (mechanism *oAuthBearerMechanism) FailureChallenge(err error) (challenge []byte) {
+	challenge, _ = json.Marshal(struct {
+		Status string `json:"status"`
+	}{
+		Status: "invalid_token",
+	})
+	return challenge
+}
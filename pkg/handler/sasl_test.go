@@ -0,0 +1,183 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSASLMechanisms(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		mechanism string
+		responses []string
+	}
+	tests := []struct {
+		name         string
+		args         args
+		wantStart    string
+		wantUser     string
+		wantPassword string
+		wantErr      bool
+	}{
+		{
+			name: "PLAIN",
+			args: args{
+				mechanism: "PLAIN",
+				responses: []string{"\x00user\x00password"},
+			},
+			wantUser:     "user",
+			wantPassword: "password",
+		},
+		{
+			name: "PLAIN authzid",
+			args: args{
+				mechanism: "PLAIN",
+				responses: []string{"user\x00user\x00password"},
+			},
+			wantUser:     "user",
+			wantPassword: "password",
+		},
+		{
+			name: "PLAIN authzid mismatch",
+			args: args{
+				mechanism: "PLAIN",
+				responses: []string{"admin\x00user\x00password"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "PLAIN invalid",
+			args: args{
+				mechanism: "PLAIN",
+				responses: []string{"user\x00password"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "PLAIN empty password",
+			args: args{
+				mechanism: "PLAIN",
+				responses: []string{"\x00user\x00"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "LOGIN",
+			args: args{
+				mechanism: "LOGIN",
+				responses: []string{"user", "password"},
+			},
+			wantStart:    "Username:",
+			wantUser:     "user",
+			wantPassword: "password",
+		},
+		{
+			name: "LOGIN empty user",
+			args: args{
+				mechanism: "LOGIN",
+				responses: []string{""},
+			},
+			wantStart: "Username:",
+			wantErr:   true,
+		},
+		{
+			name: "XOAUTH2",
+			args: args{
+				mechanism: "XOAUTH2",
+				responses: []string{"user=user\x01auth=Bearer token\x01\x01"},
+			},
+			wantUser:     "user",
+			wantPassword: "token",
+		},
+		{
+			name: "XOAUTH2 missing terminator",
+			args: args{
+				mechanism: "XOAUTH2",
+				responses: []string{"user=user\x01auth=Bearer token\x01"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "XOAUTH2 invalid scheme",
+			args: args{
+				mechanism: "XOAUTH2",
+				responses: []string{"user=user\x01auth=Basic token\x01\x01"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "OAUTHBEARER",
+			args: args{
+				mechanism: "OAUTHBEARER",
+				responses: []string{"n,a=user=2Cname,\x01host=localhost\x01port=110\x01auth=Bearer token\x01\x01"},
+			},
+			wantUser:     "user,name",
+			wantPassword: "token",
+		},
+		{
+			name: "OAUTHBEARER no authzid",
+			args: args{
+				mechanism: "OAUTHBEARER",
+				responses: []string{"n,,\x01auth=bearer token\x01\x01"},
+			},
+			wantPassword: "token",
+		},
+		{
+			name: "OAUTHBEARER channel binding",
+			args: args{
+				mechanism: "OAUTHBEARER",
+				responses: []string{"p=tls-unique,,\x01auth=Bearer token\x01\x01"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "OAUTHBEARER missing token",
+			args: args{
+				mechanism: "OAUTHBEARER",
+				responses: []string{"n,,\x01\x01"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			mechanism := saslMechanisms[tt.args.mechanism]()
+			assert.EqualValues(t, tt.wantStart, mechanism.Start())
+			var err error
+			done := false
+			for _, response := range tt.args.responses {
+				assert.False(t, done)
+				_, done, err = mechanism.Next([]byte(response))
+				if err != nil {
+					break
+				}
+			}
+			assert.EqualValues(t, tt.wantErr, err != nil)
+			if !tt.wantErr {
+				assert.True(t, done)
+				user, password := mechanism.Credentials()
+				assert.EqualValues(t, tt.wantUser, user)
+				assert.EqualValues(t, tt.wantPassword, password)
+			}
+		})
+	}
+}
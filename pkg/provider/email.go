@@ -22,8 +22,13 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"mime"
+	"net/mail"
 	"sort"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 type EmailPayload []byte
@@ -42,47 +47,220 @@ You received this message because you successfully set up aws-ses-pop3-server.`,
 	sha := hash.Sum(nil)
 	return Email{
 		ID:      hex.EncodeToString(sha),
-		Size:    int64(len(payload)),
+		Size:    payload.WireSize(),
 		Payload: &payload,
 	}
 }()
 
 type Email struct {
-	ID      string
+	ID string
+	// Size is the exact number of octets sent by RETR before the termination line.
 	Size    int64
 	Payload *EmailPayload
 }
 
-func (payload EmailPayload) ParseAll() (lines []string, err error) {
-	return parse(payload, true, 0)
+// WireSize returns the number of octets of payload after it has been encoded using EncodeMessage.
+func (payload EmailPayload) WireSize() int64 {
+	written, _ := EncodeMessage(io.Discard, bytes.NewReader(payload), -1)
+	return written
 }
 
-func (payload EmailPayload) ParseHeaders(x int) (lines []string, err error) {
-	return parse(payload, false, x)
+// DowngradeHeaders replaces non-ASCII words in the header fields of payload by MIME encoded-words
+// for clients that have not enabled UTF8. Encoded-words are only allowed in unstructured fields and
+// display names, so other fields and non-ASCII addr-specs are left untouched as is the body.
+// Source: https://www.ietf.org/rfc/rfc6856.txt, https://www.ietf.org/rfc/rfc2047.txt
+func (payload EmailPayload) DowngradeHeaders() EmailPayload {
+	var downgraded EmailPayload
+	var field []byte
+	flush := func() {
+		downgraded = append(downgraded, downgradeField(field)...)
+		field = nil
+	}
+	rest := []byte(payload)
+	for len(rest) > 0 {
+		line := rest
+		if index := bytes.IndexByte(rest, '\n'); index >= 0 {
+			line = rest[:index+1]
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			flush()
+		}
+		field = append(field, line...)
+		rest = rest[len(line):]
+	}
+	flush()
+	return append(downgraded, rest...)
+}
+
+// addressFields are the header fields that hold address lists.
+// Source: https://www.ietf.org/rfc/rfc5322.txt
+var addressFields = map[string]bool{
+	"from":          true,
+	"sender":        true,
+	"reply-to":      true,
+	"to":            true,
+	"cc":            true,
+	"bcc":           true,
+	"resent-from":   true,
+	"resent-sender": true,
+	"resent-to":     true,
+	"resent-cc":     true,
+	"resent-bcc":    true,
+}
+
+// unstructuredFields are the header fields whose words may all be replaced by encoded-words.
+// Source: https://www.ietf.org/rfc/rfc5322.txt, https://www.ietf.org/rfc/rfc2045.txt
+var unstructuredFields = map[string]bool{
+	"subject":             true,
+	"comments":            true,
+	"content-description": true,
+}
+
+func downgradeField(field []byte) []byte {
+	if isASCII(field) {
+		return field
+	}
+	lineEnding, fieldEnding := "\n", ""
+	if bytes.HasSuffix(field, []byte("\r\n")) {
+		lineEnding, fieldEnding = "\r\n", "\r\n"
+	} else if bytes.HasSuffix(field, []byte("\n")) {
+		fieldEnding = "\n"
+	}
+	name, value, found := strings.Cut(string(field), ":")
+	if !found {
+		return field
+	}
+	var words []string
+	switch key := strings.ToLower(strings.TrimSpace(name)); {
+	case unstructuredFields[key]:
+		words = encodeWords(value)
+	case addressFields[key]:
+		words, found = encodeAddressList(value)
+		if !found {
+			return field
+		}
+	default:
+		return field
+	}
+	// Fold the field so that lines do not exceed 78 characters where possible.
+	folded := name + ":"
+	lineLength := len(folded)
+	for _, word := range words {
+		if lineLength+1+len(word) > 78 && lineLength > len(name)+1 {
+			folded += lineEnding
+			lineLength = 0
+		}
+		folded += " " + word
+		lineLength += 1 + len(word)
+	}
+	return []byte(folded + fieldEnding)
 }
 
-func parse(payload EmailPayload, all bool, x int) (lines []string, err error) {
-	reader := bytes.NewReader(payload)
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		line := scanner.Text()
-		lines = append(lines, line)
-		if !all && line == "" {
-			for x > 0 {
-				if scanner.Scan() {
-					lines = append(lines, scanner.Text())
-					x--
-				} else {
-					break
-				}
+// encodeWords replaces the non-ASCII words of an unstructured field value by encoded-words.
+func encodeWords(value string) (words []string) {
+	// Consecutive non-ASCII words are encoded together as whitespace between encoded-words is ignored.
+	var run []string
+	for _, word := range strings.Fields(value) {
+		if isASCII([]byte(word)) {
+			if len(run) > 0 {
+				words = append(words, strings.Fields(mime.QEncoding.Encode("utf-8", strings.Join(run, " ")))...)
+				run = nil
 			}
-			break
+			words = append(words, word)
+		} else {
+			run = append(run, word)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	if len(run) > 0 {
+		words = append(words, strings.Fields(mime.QEncoding.Encode("utf-8", strings.Join(run, " ")))...)
+	}
+	return words
+}
+
+// encodeAddressList encodes the display names of the addresses in value and returns one word per address.
+// Non-ASCII addr-specs are kept as there is no ASCII alternative. It fails for invalid address lists and
+// groups as they are not preserved by net/mail.
+// Source: https://www.ietf.org/rfc/rfc6857.txt
+func encodeAddressList(value string) (words []string, ok bool) {
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	if strings.Contains(value, ";") {
+		return nil, false
+	}
+	addresses, err := mail.ParseAddressList(value)
+	if err != nil {
+		return nil, false
+	}
+	for index, address := range addresses {
+		// String encodes the display name if needed and quotes the local part of the addr-spec if required.
+		word := address.String()
+		if address.Name == "" {
+			word = strings.TrimSuffix(strings.TrimPrefix(word, "<"), ">")
+		}
+		if index < len(addresses)-1 {
+			word += ","
+		}
+		words = append(words, word)
+	}
+	return words, true
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// NewHeaderDowngrader returns a reader that applies DowngradeHeaders to the message read from src.
+// Only the header section is kept in memory.
+func NewHeaderDowngrader(src io.Reader) io.Reader {
+	return &headerDowngrader{src: bufio.NewReader(src)}
+}
+
+type headerDowngrader struct {
+	src    *bufio.Reader
+	reader io.Reader
+}
+
+func (downgrader *headerDowngrader) Read(b []byte) (n int, err error) {
+	if downgrader.reader == nil {
+		headers, err := readHeaders(downgrader.src)
+		if err != nil {
+			return 0, err
+		}
+		downgrader.reader = io.MultiReader(bytes.NewReader(headers.DowngradeHeaders()), downgrader.src)
+	}
+	return downgrader.reader.Read(b)
+}
+
+// readHeaders reads the header section including the blank line that separates it from the body.
+func readHeaders(src *bufio.Reader) (headers EmailPayload, err error) {
+	for {
+		line, err := src.ReadBytes('\n')
+		headers = append(headers, line...)
+		if err == io.EOF || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return headers, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// DowngradeDelta returns by how many octets DowngradeHeaders changes the wire size of the message read
+// from src, i.e. the difference between the sizes sent with and without downgrading. Only the header
+// section is read as the body is left untouched.
+func DowngradeDelta(src io.Reader) (delta int64, err error) {
+	headers, err := readHeaders(bufio.NewReader(src))
+	if err != nil {
+		return 0, err
 	}
-	return lines, nil
+	return headers.DowngradeHeaders().WireSize() - headers.WireSize(), nil
 }
 
 func GetSortedMailNumbers(emails map[int]*Email) []int {
@@ -17,186 +17,114 @@
 package provider
 
 import (
+	"bytes"
+	"io"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestParse(t *testing.T) {
+func TestWireSize(t *testing.T) {
 	t.Parallel()
-	type args struct {
+	tests := []struct {
+		name    string
 		payload EmailPayload
-		all     bool
-		x       int
+		want    int64
+	}{
+		{
+			name:    "CRLF",
+			payload: []byte("a\r\nb\r\n"),
+			want:    6,
+		},
+		{
+			name:    "LF",
+			payload: []byte("a\nb\n"),
+			want:    6,
+		},
+		{
+			name:    "byte-stuffing",
+			payload: []byte(".a\n.\n"),
+			want:    9,
+		},
+		{
+			name:    "missing trailing newline",
+			payload: []byte("a\nb"),
+			want:    6,
+		},
+		{
+			name: "empty",
+		},
 	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.EqualValues(t, tt.want, tt.payload.WireSize())
+		})
+	}
+}
+
+func TestDowngradeHeaders(t *testing.T) {
+	t.Parallel()
 	tests := []struct {
 		name    string
-		args    args
-		want    []string
-		wantErr bool
+		payload EmailPayload
+		want    EmailPayload
 	}{
 		{
-			name: "all",
-			args: args{
-				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
-From: Jane Doe <jane.doe@example.com>
-To: john.doe@example.com
-Subject: Hello
-Content-Type: text/plain; charset=us-ascii; format=flowed
-Content-Transfer-Encoding: 7bit
-
-Hi John,
-
-How are you?
-
-Best
-Jane`),
-				all: true,
-			},
-			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
-				"From: Jane Doe <jane.doe@example.com>",
-				"To: john.doe@example.com",
-				"Subject: Hello",
-				"Content-Type: text/plain; charset=us-ascii; format=flowed",
-				"Content-Transfer-Encoding: 7bit",
-				"",
-				"Hi John,",
-				"",
-				"How are you?",
-				"",
-				"Best",
-				"Jane"},
+			name:    "ASCII",
+			payload: []byte("Subject: Hello\r\n\r\nBody\r\n"),
+			want:    []byte("Subject: Hello\r\n\r\nBody\r\n"),
 		},
 		{
-			name: "all trailing new line",
-			args: args{
-				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
-From: Jane Doe <jane.doe@example.com>
-To: john.doe@example.com
-Subject: Hello
-Content-Type: text/plain; charset=us-ascii; format=flowed
-Content-Transfer-Encoding: 7bit
-
-Hi John,
-
-How are you?
-
-Best
-Jane
-`),
-				all: true,
-			},
-			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
-				"From: Jane Doe <jane.doe@example.com>",
-				"To: john.doe@example.com",
-				"Subject: Hello",
-				"Content-Type: text/plain; charset=us-ascii; format=flowed",
-				"Content-Transfer-Encoding: 7bit",
-				"",
-				"Hi John,",
-				"",
-				"How are you?",
-				"",
-				"Best",
-				"Jane"},
+			name:    "non-ASCII word",
+			payload: []byte("Subject: Grüße aus Köln\nTo: a@example.com\n\nGrüße\n"),
+			want:    []byte("Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?= aus =?utf-8?q?K=C3=B6ln?=\nTo: a@example.com\n\nGrüße\n"),
 		},
 		{
-			name: "headers",
-			args: args{
-				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
-From: Jane Doe <jane.doe@example.com>
-To: john.doe@example.com
-Subject: Hello
-Content-Type: text/plain; charset=us-ascii; format=flowed
-Content-Transfer-Encoding: 7bit
-
-Hi John,
-
-How are you?
-
-Best
-Jane`),
-				all: false,
-			},
-			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
-				"From: Jane Doe <jane.doe@example.com>",
-				"To: john.doe@example.com",
-				"Subject: Hello",
-				"Content-Type: text/plain; charset=us-ascii; format=flowed",
-				"Content-Transfer-Encoding: 7bit",
-				"",
-			},
+			name:    "consecutive non-ASCII words",
+			payload: []byte("Subject: Grüße Köln\n\n"),
+			want:    []byte("Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe_K=C3=B6ln?=\n\n"),
 		},
 		{
-			name: "headers x",
-			args: args{
-				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
-From: Jane Doe <jane.doe@example.com>
-To: john.doe@example.com
-Subject: Hello
-Content-Type: text/plain; charset=us-ascii; format=flowed
-Content-Transfer-Encoding: 7bit
-
-Hi John,
-
-How are you?
-
-Best
-Jane`),
-				x: 3,
-			},
-			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
-				"From: Jane Doe <jane.doe@example.com>",
-				"To: john.doe@example.com",
-				"Subject: Hello",
-				"Content-Type: text/plain; charset=us-ascii; format=flowed",
-				"Content-Transfer-Encoding: 7bit",
-				"",
-				"Hi John,",
-				"",
-				"How are you?",
-			},
+			name:    "without body",
+			payload: []byte("Subject: ö"),
+			want:    []byte("Subject: =?utf-8?q?=C3=B6?="),
 		},
 		{
-			name: "headers x out of range",
-			args: args{
-				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
-From: Jane Doe <jane.doe@example.com>
-To: john.doe@example.com
-Subject: Hello
-Content-Type: text/plain; charset=us-ascii; format=flowed
-Content-Transfer-Encoding: 7bit
-
-Hi John,
-
-How are you?
-
-Best
-Jane`),
-				x: 7000,
-			},
-			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
-				"From: Jane Doe <jane.doe@example.com>",
-				"To: john.doe@example.com",
-				"Subject: Hello",
-				"Content-Type: text/plain; charset=us-ascii; format=flowed",
-				"Content-Transfer-Encoding: 7bit",
-				"",
-				"Hi John,",
-				"",
-				"How are you?",
-				"",
-				"Best",
-				"Jane"},
+			name:    "display names",
+			payload: []byte("From: Jürgen <j@example.de>\r\nTo: \"Müller, Hans\" <hans@example.de>, a@example.com\r\n\r\n"),
+			want: []byte("From: =?utf-8?q?J=C3=BCrgen?= <j@example.de>\r\n" +
+				"To: =?utf-8?b?TcO8bGxlciwgSGFucw==?= <hans@example.de>, a@example.com\r\n\r\n"),
+		},
+		{
+			name:    "non-ASCII addr-spec",
+			payload: []byte("From: jürgen@example.de\nTo: Jürgen <jürgen@example.de>\n\n"),
+			want:    []byte("From: jürgen@example.de\nTo: =?utf-8?q?J=C3=BCrgen?= <jürgen@example.de>\n\n"),
+		},
+		{
+			name:    "group",
+			payload: []byte("To: Grüße: a@example.com;\n\n"),
+			want:    []byte("To: Grüße: a@example.com;\n\n"),
+		},
+		{
+			name:    "structured field",
+			payload: []byte("Message-ID: <ö@example.de>\nKeywords: Grüße\n\n"),
+			want:    []byte("Message-ID: <ö@example.de>\nKeywords: Grüße\n\n"),
 		},
 	}
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			got, err := parse(tt.args.payload, tt.args.all, tt.args.x)
-			assert.EqualValues(t, tt.wantErr, err != nil)
-			assert.EqualValues(t, tt.want, got)
+			assert.EqualValues(t, string(tt.want), string(tt.payload.DowngradeHeaders()))
+			downgraded, err := io.ReadAll(NewHeaderDowngrader(iotest.OneByteReader(bytes.NewReader(tt.payload))))
+			assert.NoError(t, err)
+			assert.EqualValues(t, string(tt.want), string(downgraded))
+			delta, err := DowngradeDelta(bytes.NewReader(tt.payload))
+			assert.NoError(t, err)
+			assert.EqualValues(t, EmailPayload(tt.want).WireSize()-tt.payload.WireSize(), delta)
 		})
 	}
 }
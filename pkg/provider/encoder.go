@@ -0,0 +1,158 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"bufio"
+	"io"
+)
+
+// EncodeMessage streams the message read from src to dst as the content of a multi-line response
+// without the terminating line: line endings (CRLF or bare LF) are normalised to CRLF, lines starting
+// with the termination octet are byte-stuffed and a missing final line ending is added. All other octets,
+// including bare CRs and 8-bit data, are passed through unchanged and lines may be of any length.
+// If bodyLines is not negative, only the headers, the blank line separating them from the body
+// and the first bodyLines lines of the body are written.
+// Source: https://www.ietf.org/rfc/rfc1939.txt
+func EncodeMessage(dst io.Writer, src io.Reader, bodyLines int) (written int64, err error) {
+	counter := &countingWriter{writer: dst}
+	encoder := &messageEncoder{
+		writer:    bufio.NewWriter(counter),
+		lineStart: true,
+		bodyLines: bodyLines,
+	}
+	buf := make([]byte, 32*1024)
+	for !encoder.done {
+		n, readErr := src.Read(buf)
+		encoder.encode(buf[:n])
+		if counter.err != nil {
+			// Stop reading the source as soon as the destination fails.
+			return counter.written, counter.err
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			encoder.writer.Flush()
+			return counter.written, readErr
+		}
+	}
+	encoder.close()
+	if err := encoder.writer.Flush(); err != nil {
+		return counter.written, err
+	}
+	return counter.written, nil
+}
+
+type messageEncoder struct {
+	writer *bufio.Writer
+	// lineStart is true if no octet of the current line has been written yet.
+	lineStart bool
+	// pendingCR is true if the previous octet was a CR that may start a CRLF line ending.
+	pendingCR bool
+	// inBody is true once the blank line separating the headers from the body has been written.
+	inBody    bool
+	bodyLines int
+	done      bool
+}
+
+func (encoder *messageEncoder) encode(data []byte) {
+	for _, octet := range data {
+		if encoder.done {
+			return
+		}
+		if octet == '\n' {
+			encoder.startLine()
+			encoder.endLine()
+			continue
+		}
+		if encoder.pendingCR {
+			// The previous CR was not part of a line ending.
+			encoder.pendingCR = false
+			encoder.content('\r')
+		}
+		encoder.startLine()
+		if octet == '\r' {
+			encoder.pendingCR = true
+		} else {
+			encoder.content(octet)
+		}
+	}
+}
+
+// startLine counts the lines of the body once the first octet of a line is read.
+func (encoder *messageEncoder) startLine() {
+	if !encoder.lineStart || encoder.pendingCR || !encoder.inBody || encoder.bodyLines < 0 {
+		return
+	}
+	if encoder.bodyLines == 0 {
+		encoder.done = true
+		return
+	}
+	encoder.bodyLines--
+}
+
+func (encoder *messageEncoder) content(octet byte) {
+	if encoder.done {
+		return
+	}
+	if encoder.lineStart && octet == '.' {
+		encoder.writer.WriteByte('.')
+	}
+	encoder.writer.WriteByte(octet)
+	encoder.lineStart = false
+}
+
+func (encoder *messageEncoder) endLine() {
+	if encoder.done {
+		return
+	}
+	if encoder.lineStart && !encoder.inBody {
+		encoder.inBody = true
+	}
+	encoder.writer.WriteString("\r\n")
+	encoder.lineStart = true
+	encoder.pendingCR = false
+}
+
+// close terminates the last line if the message does not end with a line ending.
+// A final bare CR is treated as line ending.
+func (encoder *messageEncoder) close() {
+	if encoder.done {
+		return
+	}
+	if encoder.pendingCR || !encoder.lineStart {
+		encoder.endLine()
+	}
+}
+
+// countingWriter counts the written bytes and remembers the first write error.
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+	err     error
+}
+
+func (writer *countingWriter) Write(b []byte) (n int, err error) {
+	if writer.err != nil {
+		return 0, writer.err
+	}
+	n, err = writer.writer.Write(b)
+	writer.written += int64(n)
+	writer.err = err
+	return n, err
+}
@@ -0,0 +1,374 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (n int, err error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestEncodeMessageWriteError(t *testing.T) {
+	t.Parallel()
+	src := strings.NewReader(strings.Repeat("line\n", 1024*1024))
+	written, err := EncodeMessage(failingWriter{}, src, -1)
+	assert.EqualError(t, err, "connection reset")
+	assert.EqualValues(t, 0, written)
+	// The source is not read to the end after the first failed write.
+	assert.Greater(t, src.Len(), 0)
+}
+
+func TestEncodeMessage(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		payload   EmailPayload
+		bodyLines int
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "all",
+			args: args{
+				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
+From: Jane Doe <jane.doe@example.com>
+To: john.doe@example.com
+Subject: Hello
+Content-Type: text/plain; charset=us-ascii; format=flowed
+Content-Transfer-Encoding: 7bit
+
+Hi John,
+
+How are you?
+
+Best
+Jane`),
+				bodyLines: -1,
+			},
+			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
+				"From: Jane Doe <jane.doe@example.com>",
+				"To: john.doe@example.com",
+				"Subject: Hello",
+				"Content-Type: text/plain; charset=us-ascii; format=flowed",
+				"Content-Transfer-Encoding: 7bit",
+				"",
+				"Hi John,",
+				"",
+				"How are you?",
+				"",
+				"Best",
+				"Jane"},
+		},
+		{
+			name: "all trailing new line",
+			args: args{
+				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
+From: Jane Doe <jane.doe@example.com>
+To: john.doe@example.com
+Subject: Hello
+Content-Type: text/plain; charset=us-ascii; format=flowed
+Content-Transfer-Encoding: 7bit
+
+Hi John,
+
+How are you?
+
+Best
+Jane
+`),
+				bodyLines: -1,
+			},
+			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
+				"From: Jane Doe <jane.doe@example.com>",
+				"To: john.doe@example.com",
+				"Subject: Hello",
+				"Content-Type: text/plain; charset=us-ascii; format=flowed",
+				"Content-Transfer-Encoding: 7bit",
+				"",
+				"Hi John,",
+				"",
+				"How are you?",
+				"",
+				"Best",
+				"Jane"},
+		},
+		{
+			name: "headers",
+			args: args{
+				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
+From: Jane Doe <jane.doe@example.com>
+To: john.doe@example.com
+Subject: Hello
+Content-Type: text/plain; charset=us-ascii; format=flowed
+Content-Transfer-Encoding: 7bit
+
+Hi John,
+
+How are you?
+
+Best
+Jane`),
+				bodyLines: 0,
+			},
+			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
+				"From: Jane Doe <jane.doe@example.com>",
+				"To: john.doe@example.com",
+				"Subject: Hello",
+				"Content-Type: text/plain; charset=us-ascii; format=flowed",
+				"Content-Transfer-Encoding: 7bit",
+				"",
+			},
+		},
+		{
+			name: "headers x",
+			args: args{
+				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
+From: Jane Doe <jane.doe@example.com>
+To: john.doe@example.com
+Subject: Hello
+Content-Type: text/plain; charset=us-ascii; format=flowed
+Content-Transfer-Encoding: 7bit
+
+Hi John,
+
+How are you?
+
+Best
+Jane`),
+				bodyLines: 3,
+			},
+			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
+				"From: Jane Doe <jane.doe@example.com>",
+				"To: john.doe@example.com",
+				"Subject: Hello",
+				"Content-Type: text/plain; charset=us-ascii; format=flowed",
+				"Content-Transfer-Encoding: 7bit",
+				"",
+				"Hi John,",
+				"",
+				"How are you?",
+			},
+		},
+		{
+			name: "headers x out of range",
+			args: args{
+				payload: []byte(`Date: Mon, 20 Apr 2020 11:134:13 +0200
+From: Jane Doe <jane.doe@example.com>
+To: john.doe@example.com
+Subject: Hello
+Content-Type: text/plain; charset=us-ascii; format=flowed
+Content-Transfer-Encoding: 7bit
+
+Hi John,
+
+How are you?
+
+Best
+Jane`),
+				bodyLines: 7000,
+			},
+			want: []string{"Date: Mon, 20 Apr 2020 11:134:13 +0200",
+				"From: Jane Doe <jane.doe@example.com>",
+				"To: john.doe@example.com",
+				"Subject: Hello",
+				"Content-Type: text/plain; charset=us-ascii; format=flowed",
+				"Content-Transfer-Encoding: 7bit",
+				"",
+				"Hi John,",
+				"",
+				"How are you?",
+				"",
+				"Best",
+				"Jane"},
+		},
+		{
+			name: "CRLF and byte-stuffing",
+			args: args{
+				payload:   []byte("Subject: Hello\r\n\r\n.\r\n..\r\n.Hi\r\nJa.ne\r\n"),
+				bodyLines: -1,
+			},
+			want: []string{"Subject: Hello",
+				"",
+				"..",
+				"...",
+				"..Hi",
+				"Ja.ne"},
+		},
+		{
+			name: "bare CR",
+			args: args{
+				payload:   []byte("a\rb\r\r\n\r.c\r"),
+				bodyLines: -1,
+			},
+			want: []string{"a\rb\r",
+				"\r.c"},
+		},
+		{
+			name: "missing trailing newline after byte-stuffing",
+			args: args{
+				payload:   []byte("a\n."),
+				bodyLines: -1,
+			},
+			want: []string{"a",
+				".."},
+		},
+		{
+			name: "8-bit",
+			args: args{
+				payload:   []byte("Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\n\nGr\xc3\xbc\xc3\x9fe \x00\xff\n"),
+				bodyLines: -1,
+			},
+			want: []string{"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=",
+				"",
+				"Gr\xc3\xbc\xc3\x9fe \x00\xff"},
+		},
+		{
+			name: "long line",
+			args: args{
+				payload:   []byte("Subject: long\n\n" + strings.Repeat("QUJD", 100000) + "\n.end"),
+				bodyLines: -1,
+			},
+			want: []string{"Subject: long",
+				"",
+				strings.Repeat("QUJD", 100000),
+				"..end"},
+		},
+		{
+			name: "headers with CR LF",
+			args: args{
+				payload:   []byte("Subject: Hello\r\n\r\nline 1\r\nline 2\r\n"),
+				bodyLines: 1,
+			},
+			want: []string{"Subject: Hello",
+				"",
+				"line 1"},
+		},
+		{
+			name: "headers only",
+			args: args{
+				payload:   []byte("Subject: Hello\n"),
+				bodyLines: 0,
+			},
+			want: []string{"Subject: Hello"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			want := strings.Join(tt.want, "\r\n") + "\r\n"
+			var buf bytes.Buffer
+			written, err := EncodeMessage(&buf, bytes.NewReader(tt.args.payload), tt.args.bodyLines)
+			assert.EqualValues(t, tt.wantErr, err != nil)
+			assert.EqualValues(t, want, buf.String())
+			assert.EqualValues(t, len(want), written)
+
+			// The output must not depend on how the input is split into reads.
+			buf.Reset()
+			written, err = EncodeMessage(&buf, iotest.OneByteReader(bytes.NewReader(tt.args.payload)), tt.args.bodyLines)
+			assert.EqualValues(t, tt.wantErr, err != nil)
+			assert.EqualValues(t, want, buf.String())
+			assert.EqualValues(t, len(want), written)
+		})
+	}
+}
+
+// decodeMessage reverses the byte-stuffing of the content of a multi-line response.
+func decodeMessage(encoded []byte) (lines [][]byte) {
+	for _, line := range bytes.SplitAfter(encoded, []byte("\r\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		lines = append(lines, bytes.TrimPrefix(line, []byte(".")))
+	}
+	return lines
+}
+
+func FuzzEncodeMessage(f *testing.F) {
+	f.Add([]byte("Subject: Hello\n\nHi\n.\n"), 1)
+	f.Add([]byte("a\rb\r\r\n\r.c\r"), -1)
+	f.Add([]byte(".\r\n..\r\n"), 0)
+	f.Add([]byte("\n\n\n"), 2)
+	f.Add([]byte("\xff\x00\r"), -1)
+	f.Fuzz(func(t *testing.T, payload []byte, bodyLines int) {
+		if bodyLines < -1 {
+			bodyLines = -1
+		}
+		var buf bytes.Buffer
+		written, err := EncodeMessage(&buf, bytes.NewReader(payload), bodyLines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded := buf.Bytes()
+		if int64(len(encoded)) != written {
+			t.Fatalf("written %v octets but counted %v", len(encoded), written)
+		}
+		if len(encoded) > 0 && !bytes.HasSuffix(encoded, []byte("\r\n")) {
+			t.Fatalf("missing final line ending: %q", encoded)
+		}
+		lines := decodeMessage(encoded)
+		for _, line := range lines {
+			if !bytes.HasSuffix(line, []byte("\r\n")) || bytes.Contains(line[:len(line)-2], []byte("\n")) {
+				t.Fatalf("line is not terminated by a single CRLF: %q", line)
+			}
+		}
+		for _, line := range bytes.SplitAfter(encoded, []byte("\r\n")) {
+			if bytes.Equal(line, []byte(".\r\n")) {
+				t.Fatalf("content contains the termination line: %q", encoded)
+			}
+		}
+
+		// The decoded content equals the payload with normalised line endings.
+		normalised := bytes.ReplaceAll(payload, []byte("\r\n"), []byte("\n"))
+		normalised = bytes.ReplaceAll(normalised, []byte("\n"), []byte("\r\n"))
+		if bytes.HasSuffix(normalised, []byte("\r")) && !bytes.HasSuffix(normalised, []byte("\r\n")) {
+			normalised = append(normalised, '\n')
+		}
+		if len(normalised) > 0 && !bytes.HasSuffix(normalised, []byte("\r\n")) {
+			normalised = append(normalised, "\r\n"...)
+		}
+		decoded := bytes.Join(lines, nil)
+		if bodyLines < 0 && !bytes.Equal(decoded, normalised) {
+			t.Fatalf("decoded %q but want %q", decoded, normalised)
+		}
+		if !bytes.HasPrefix(normalised, decoded) {
+			t.Fatalf("decoded %q is not a prefix of %q", decoded, normalised)
+		}
+
+		// The output must not depend on how the input is split into reads.
+		var oneByte bytes.Buffer
+		if _, err := EncodeMessage(&oneByte, iotest.OneByteReader(bytes.NewReader(payload)), bodyLines); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, oneByte.Bytes()) {
+			t.Fatalf("encoded %q but %q when reading one byte at a time", encoded, oneByte.Bytes())
+		}
+	})
+}
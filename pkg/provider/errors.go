@@ -0,0 +1,77 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// The errors returned by ProviderCreator and Provider wrap one of the following errors
+// so that handlers can tell the cause of a failure apart.
+var (
+	ErrAuth        = errors.New("invalid credentials")
+	ErrTemporary   = errors.New("temporary failure, try again later")
+	ErrPermanent   = errors.New("permanent failure, contact your administrator")
+	ErrInUse       = errors.New("maildrop already in use")
+	ErrLoginDelay  = errors.New("minimum time between logins not yet elapsed")
+	ErrNoSuchEmail = errors.New("no such message")
+	// ErrMaildropTooLarge is temporary as the user can reduce the number of messages using another client.
+	ErrMaildropTooLarge = errors.New("maildrop too large")
+)
+
+// wrapS3Error classifies err returned by the AWS SDK as either temporary or permanent.
+func wrapS3Error(err error) error {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) {
+		statusCode := requestFailure.StatusCode()
+		if statusCode >= 400 && statusCode < 500 &&
+			statusCode != http.StatusRequestTimeout &&
+			statusCode != http.StatusTooManyRequests {
+			return fmt.Errorf("%w: %v", ErrPermanent, err)
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrTemporary, err)
+}
+
+// wrapFileError classifies err returned by the file system as either temporary or permanent.
+func wrapFileError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+	return fmt.Errorf("%w: %v", ErrTemporary, err)
+}
+
+// DeleteError reports the emails that could not be deleted while the others were.
+// It is temporary as the remaining emails can be deleted in a later session.
+type DeleteError struct {
+	IDs []string
+	Err error
+}
+
+func (err *DeleteError) Error() string {
+	return fmt.Sprintf("failed to delete %v: %v", strings.Join(err.IDs, ", "), err.Err)
+}
+
+func (err *DeleteError) Unwrap() error {
+	return ErrTemporary
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapS3Error(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{
+			name: "access denied",
+			err:  awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"),
+			want: ErrPermanent,
+		},
+		{
+			name: "throttled",
+			err:  awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "id"),
+			want: ErrTemporary,
+		},
+		{
+			name: "too many requests",
+			err:  awserr.NewRequestFailure(awserr.New("TooManyRequests", "Too many requests", nil), 429, "id"),
+			want: ErrTemporary,
+		},
+		{
+			name: "network",
+			err:  errors.New("connection refused"),
+			want: ErrTemporary,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.ErrorIs(t, wrapS3Error(tt.err), tt.want)
+		})
+	}
+}
@@ -0,0 +1,276 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The subdirectories of a Maildir that hold delivered emails. Emails in tmp are still being delivered.
+// Source: https://cr.yp.to/proto/maildir.html
+const (
+	maildirNew = "new"
+	maildirCur = "cur"
+)
+
+// maildirFile is the location of an email within a Maildir.
+type maildirFile struct {
+	dir  string
+	name string
+}
+
+type maildirCache struct {
+	emails map[int]*Email
+	files  map[int]maildirFile
+}
+
+type maildirProvider struct {
+	identity string
+	path     string
+	cache    *maildirCache
+	policy   Policy
+}
+
+var _ Provider = &maildirProvider{}
+var _ PolicyProvider = &maildirProvider{}
+var _ IdentityProvider = &maildirProvider{}
+var _ CapabilityProvider = &maildirProvider{}
+
+func newMaildirProvider(identity, path string, policy Policy) (provider *maildirProvider, err error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: no maildir specified", ErrPermanent)
+	}
+	for _, dir := range []string{maildirNew, maildirCur} {
+		info, err := os.Stat(filepath.Join(path, dir))
+		if err != nil {
+			return nil, wrapFileError(err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%w: %v is not a maildir", ErrPermanent, path)
+		}
+	}
+	return &maildirProvider{
+		identity: identity,
+		path:     path,
+		policy:   policy,
+	}, nil
+}
+
+func (provider *maildirProvider) Policy() Policy {
+	return provider.policy
+}
+
+func (provider *maildirProvider) Identity() string {
+	return provider.identity
+}
+
+func (provider *maildirProvider) Capabilities() []string {
+	return []string{CapabilityTOP, CapabilityUIDL}
+}
+
+// uniqueName returns the part of name that identifies an email independent of its flags.
+func uniqueName(name string) string {
+	unique, _, _ := strings.Cut(name, ":")
+	return unique
+}
+
+func (provider *maildirProvider) filePath(file maildirFile) string {
+	return filepath.Join(provider.path, file.dir, file.name)
+}
+
+// initCache lists the emails in new and cur and numbers them by delivery time, i.e. the modification time of
+// the files. Ties are ordered by unique name which starts with the delivery time in seconds for most MDAs.
+func (provider *maildirProvider) initCache() (err error) {
+	var files []maildirFile
+	modTimes := make(map[maildirFile]time.Time)
+	for _, dir := range []string{maildirNew, maildirCur} {
+		entries, err := os.ReadDir(filepath.Join(provider.path, dir))
+		if err != nil {
+			return wrapFileError(err)
+		}
+		for _, entry := range entries {
+			// Files starting with a dot are not emails by convention.
+			if strings.HasPrefix(entry.Name(), ".") || !entry.Type().IsRegular() {
+				continue
+			}
+			info, err := entry.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				// The email has been moved or deleted by another client in the meantime.
+				continue
+			} else if err != nil {
+				return wrapFileError(err)
+			}
+			file := maildirFile{dir: dir, name: entry.Name()}
+			files = append(files, file)
+			modTimes[file] = info.ModTime()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		left, right := modTimes[files[i]], modTimes[files[j]]
+		if !left.Equal(right) {
+			return left.Before(right)
+		}
+		return uniqueName(files[i].name) < uniqueName(files[j].name)
+	})
+	cache := &maildirCache{
+		emails: make(map[int]*Email),
+		files:  make(map[int]maildirFile),
+	}
+	for index, file := range files {
+		number := index + 1
+		size, err := provider.wireSize(file)
+		if err != nil {
+			return err
+		}
+		cache.emails[number] = &Email{
+			ID:   uniqueName(file.name),
+			Size: size,
+		}
+		cache.files[number] = file
+	}
+	provider.cache = cache
+	return nil
+}
+
+func (provider *maildirProvider) wireSize(file maildirFile) (size int64, err error) {
+	reader, err := os.Open(provider.filePath(file))
+	if err != nil {
+		return 0, wrapFileError(err)
+	}
+	defer reader.Close()
+	size, err = EncodeMessage(io.Discard, reader, -1)
+	if err != nil {
+		return 0, wrapFileError(err)
+	}
+	return size, nil
+}
+
+func (provider *maildirProvider) ListEmails(notNumbers []int) (emails map[int]*Email, err error) {
+	if provider.cache == nil {
+		err := provider.initCache()
+		if err != nil {
+			return nil, err
+		}
+	}
+	emails = make(map[int]*Email)
+	for number, email := range provider.cache.emails {
+		emails[number] = email
+	}
+	for _, notNumber := range notNumbers {
+		delete(emails, notNumber)
+	}
+	return emails, nil
+}
+
+func (provider *maildirProvider) GetEmail(number int, notNumbers []int) (email *Email, err error) {
+	emails, err := provider.ListEmails(notNumbers)
+	if err != nil {
+		return nil, err
+	}
+	if email, exists := emails[number]; exists {
+		return email, nil
+	}
+	return nil, fmt.Errorf("%w: %v does not exist", ErrNoSuchEmail, number)
+}
+
+// GetEmailReader moves the email from new to cur as it has been seen by the client and opens it.
+func (provider *maildirProvider) GetEmailReader(number int, notNumbers []int) (reader io.ReadCloser, err error) {
+	if _, err := provider.GetEmail(number, notNumbers); err != nil {
+		return nil, err
+	}
+	file, err := provider.locate(number)
+	if err != nil {
+		return nil, err
+	}
+	if file.dir == maildirNew {
+		cur := maildirFile{dir: maildirCur, name: file.name + ":2,"}
+		if err := os.Rename(provider.filePath(file), provider.filePath(cur)); err != nil {
+			return nil, wrapFileError(err)
+		}
+		file = cur
+		provider.cache.files[number] = file
+	}
+	reader, err = os.Open(provider.filePath(file))
+	if err != nil {
+		return nil, wrapFileError(err)
+	}
+	return reader, nil
+}
+
+// locate returns the current location of the email. If it has been moved or flagged by another
+// client since the cache was initialized, it is looked up by its unique name.
+func (provider *maildirProvider) locate(number int) (file maildirFile, err error) {
+	file = provider.cache.files[number]
+	if _, err := os.Stat(provider.filePath(file)); !errors.Is(err, fs.ErrNotExist) {
+		return file, nil
+	}
+	id := provider.cache.emails[number].ID
+	for _, dir := range []string{maildirNew, maildirCur} {
+		entries, err := os.ReadDir(filepath.Join(provider.path, dir))
+		if err != nil {
+			return maildirFile{}, wrapFileError(err)
+		}
+		for _, entry := range entries {
+			if uniqueName(entry.Name()) == id {
+				file = maildirFile{dir: dir, name: entry.Name()}
+				provider.cache.files[number] = file
+				return file, nil
+			}
+		}
+	}
+	return maildirFile{}, fmt.Errorf("%w: %v has been deleted by another client", ErrNoSuchEmail, id)
+}
+
+// DeleteEmails unlinks the emails and continues on failures. Emails deleted by another client count as deleted.
+func (provider *maildirProvider) DeleteEmails(numbers []int) (err error) {
+	for _, number := range numbers {
+		if _, err := provider.GetEmail(number, nil); err != nil {
+			return err
+		}
+	}
+	var failedIDs []string
+	var errs []error
+	for _, number := range numbers {
+		id := provider.cache.emails[number].ID
+		file, err := provider.locate(number)
+		if errors.Is(err, ErrNoSuchEmail) {
+			continue
+		}
+		if err == nil {
+			err = os.Remove(provider.filePath(file))
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			failedIDs = append(failedIDs, id)
+			errs = append(errs, fmt.Errorf("%v: %w", id, err))
+		}
+	}
+	if len(failedIDs) > 0 {
+		return &DeleteError{
+			IDs: failedIDs,
+			Err: errors.Join(errs...),
+		}
+	}
+	return nil
+}
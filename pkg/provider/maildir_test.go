@@ -0,0 +1,189 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type maildirItem struct {
+	file    string
+	content string
+}
+
+// newTestMaildir creates a Maildir containing items whose modification times increase in the given order.
+func newTestMaildir(t *testing.T, items ...maildirItem) (path string) {
+	path = t.TempDir()
+	for _, dir := range []string{"cur", "new", "tmp"} {
+		require.NoError(t, os.Mkdir(filepath.Join(path, dir), 0700))
+	}
+	modTime := time.Now().Add(-time.Hour)
+	for index, item := range items {
+		file := filepath.Join(path, item.file)
+		require.NoError(t, os.WriteFile(file, []byte(item.content), 0600))
+		require.NoError(t, os.Chtimes(file, modTime, modTime.Add(time.Duration(index)*time.Minute)))
+	}
+	return path
+}
+
+func listMaildir(t *testing.T, path string) (files []string) {
+	for _, dir := range []string{"cur", "new", "tmp"} {
+		entries, err := os.ReadDir(filepath.Join(path, dir))
+		require.NoError(t, err)
+		for _, entry := range entries {
+			files = append(files, dir+"/"+entry.Name())
+		}
+	}
+	return files
+}
+
+func TestNewMaildirProvider(t *testing.T) {
+	t.Parallel()
+	_, err := newMaildirProvider("", newTestMaildir(t), Policy{})
+	assert.NoError(t, err)
+
+	_, err = newMaildirProvider("", "", Policy{})
+	assert.ErrorIs(t, err, ErrPermanent)
+
+	_, err = newMaildirProvider("", t.TempDir(), Policy{})
+	assert.ErrorIs(t, err, ErrPermanent)
+}
+
+func TestMaildirListEmails(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		items      []maildirItem
+		notNumbers []int
+		want       map[int]*Email
+	}{
+		{
+			name: "empty",
+			want: map[int]*Email{},
+		},
+		{
+			name: "new and cur",
+			items: []maildirItem{
+				{file: "new/3.M3.host", content: "Subject: c\r\n\r\n"},
+				{file: "cur/1.M1.host:2,S", content: "Subject: a\n\nbody\n"},
+				{file: "cur/2.M2.host:2,", content: "Subject: b\n\n.hidden\n"},
+			},
+			want: map[int]*Email{
+				1: {ID: "3.M3.host", Size: 14},
+				2: {ID: "1.M1.host", Size: 20},
+				3: {ID: "2.M2.host", Size: 24},
+			},
+		},
+		{
+			name: "notNumbers",
+			items: []maildirItem{
+				{file: "new/1.M1.host", content: "Subject: a\r\n\r\n"},
+				{file: "new/2.M2.host", content: "Subject: b\r\n\r\n"},
+			},
+			notNumbers: []int{1},
+			want: map[int]*Email{
+				2: {ID: "2.M2.host", Size: 14},
+			},
+		},
+		{
+			name: "ignored files",
+			items: []maildirItem{
+				{file: "tmp/1.M1.host", content: "Subject: a\r\n\r\n"},
+				{file: "cur/.hidden", content: "Subject: b\r\n\r\n"},
+				{file: "new/3.M3.host", content: "Subject: c\r\n\r\n"},
+			},
+			want: map[int]*Email{
+				1: {ID: "3.M3.host", Size: 14},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			provider, err := newMaildirProvider("", newTestMaildir(t, tt.items...), Policy{})
+			require.NoError(t, err)
+			got, err := provider.ListEmails(tt.notNumbers)
+			assert.NoError(t, err)
+			assert.EqualValues(t, tt.want, got)
+		})
+	}
+}
+
+func TestMaildirGetEmailReader(t *testing.T) {
+	t.Parallel()
+	path := newTestMaildir(t,
+		maildirItem{file: "cur/1.M1.host:2,", content: "Subject: a\r\n\r\n"},
+		maildirItem{file: "new/2.M2.host", content: "Subject: b\r\n\r\n"},
+	)
+	provider, err := newMaildirProvider("", path, Policy{})
+	require.NoError(t, err)
+
+	reader, err := provider.GetEmailReader(2, nil)
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.EqualValues(t, "Subject: b\r\n\r\n", string(content))
+	assert.EqualValues(t, []string{"cur/1.M1.host:2,", "cur/2.M2.host:2,"}, listMaildir(t, path))
+
+	// Another client flags the email after it has been listed.
+	require.NoError(t, os.Rename(filepath.Join(path, "cur/1.M1.host:2,"), filepath.Join(path, "cur/1.M1.host:2,S")))
+	reader, err = provider.GetEmailReader(1, nil)
+	require.NoError(t, err)
+	content, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.EqualValues(t, "Subject: a\r\n\r\n", string(content))
+
+	_, err = provider.GetEmailReader(1, []int{1})
+	assert.ErrorIs(t, err, ErrNoSuchEmail)
+
+	require.NoError(t, os.Remove(filepath.Join(path, "cur/1.M1.host:2,S")))
+	_, err = provider.GetEmailReader(1, nil)
+	assert.ErrorIs(t, err, ErrNoSuchEmail)
+}
+
+func TestMaildirDeleteEmails(t *testing.T) {
+	t.Parallel()
+	path := newTestMaildir(t,
+		maildirItem{file: "cur/1.M1.host:2,S", content: "Subject: a\r\n\r\n"},
+		maildirItem{file: "new/2.M2.host", content: "Subject: b\r\n\r\n"},
+		maildirItem{file: "new/3.M3.host", content: "Subject: c\r\n\r\n"},
+		maildirItem{file: "new/4.M4.host", content: "Subject: d\r\n\r\n"},
+	)
+	provider, err := newMaildirProvider("", path, Policy{})
+	require.NoError(t, err)
+	_, err = provider.ListEmails(nil)
+	require.NoError(t, err)
+
+	// Another client moves one email and deletes another one after they have been listed.
+	require.NoError(t, os.Rename(filepath.Join(path, "new/2.M2.host"), filepath.Join(path, "cur/2.M2.host:2,S")))
+	require.NoError(t, os.Remove(filepath.Join(path, "new/3.M3.host")))
+
+	assert.NoError(t, provider.DeleteEmails([]int{1, 2, 3}))
+	assert.EqualValues(t, []string{"new/4.M4.host"}, listMaildir(t, path))
+
+	assert.ErrorIs(t, provider.DeleteEmails([]int{5}), ErrNoSuchEmail)
+}
@@ -0,0 +1,507 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLockTimeout is the time to wait for locks held by MDAs or other clients.
+	defaultLockTimeout = 10 * time.Second
+	lockRetryInterval  = 100 * time.Millisecond
+	// staleDotlockAge is the age after which dotlocks are removed as their owner has most likely crashed.
+	staleDotlockAge = 5 * time.Minute
+)
+
+// mboxMessage is the location of a message within an mbox file.
+type mboxMessage struct {
+	// start is the offset of the From line that is expected there when the file is accessed again.
+	start int64
+	from  []byte
+	// offset and length describe the escaped message without the empty line preceding the next From line.
+	offset int64
+	length int64
+	// end is the offset of the next From line or the end of the file.
+	end int64
+}
+
+type mboxCache struct {
+	emails   map[int]*Email
+	messages map[int]mboxMessage
+	// info and size identify the indexed version of the file as it is replaced when deletions are committed.
+	info os.FileInfo
+	size int64
+}
+
+type mboxProvider struct {
+	identity    string
+	path        string
+	cache       *mboxCache
+	policy      Policy
+	lockTimeout time.Duration
+}
+
+var _ Provider = &mboxProvider{}
+var _ PolicyProvider = &mboxProvider{}
+var _ IdentityProvider = &mboxProvider{}
+var _ CapabilityProvider = &mboxProvider{}
+
+func newMboxProvider(identity, path string, policy Policy) (provider *mboxProvider, err error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: no mbox specified", ErrPermanent)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, wrapFileError(err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %v is not an mbox file", ErrPermanent, path)
+	}
+	return &mboxProvider{
+		identity:    identity,
+		path:        path,
+		policy:      policy,
+		lockTimeout: defaultLockTimeout,
+	}, nil
+}
+
+func (provider *mboxProvider) Policy() Policy {
+	return provider.policy
+}
+
+func (provider *mboxProvider) Identity() string {
+	return provider.identity
+}
+
+func (provider *mboxProvider) Capabilities() []string {
+	return []string{CapabilityTOP, CapabilityUIDL}
+}
+
+// isFromLine reports whether line separates two messages. Lines of the body starting with From are
+// escaped by mboxrd and mboxo writers.
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+func isEmptyLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// initCache indexes the messages of the file under a shared lock that keeps MDAs from appending
+// while the file is read.
+func (provider *mboxProvider) initCache() (err error) {
+	unlock, err := lockPath(provider.path, false, provider.lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := os.Open(provider.path)
+	if err != nil {
+		return wrapFileError(err)
+	}
+	defer file.Close()
+	if err := lockFile(file, false, provider.lockTimeout); err != nil {
+		return err
+	}
+	defer unlockFile(file)
+	info, err := file.Stat()
+	if err != nil {
+		return wrapFileError(err)
+	}
+	messages, size, err := indexMbox(file)
+	if err != nil {
+		return err
+	}
+	cache := &mboxCache{
+		emails:   make(map[int]*Email),
+		messages: make(map[int]mboxMessage),
+		info:     info,
+		size:     size,
+	}
+	ids := make(map[string]int)
+	for index, message := range messages {
+		number := index + 1
+		id, size, err := provider.identify(file, message)
+		if err != nil {
+			return err
+		}
+		// Identical copies are told apart by their occurrence. Unlike copies that differ, e.g. in their Received
+		// headers, a remaining copy may take over the UID of a deleted one as the client already has its content.
+		ids[id]++
+		if count := ids[id]; count > 1 {
+			id += "-" + strconv.Itoa(count)
+		}
+		cache.emails[number] = &Email{
+			ID:   id,
+			Size: size,
+		}
+		cache.messages[number] = message
+	}
+	provider.cache = cache
+	return nil
+}
+
+// indexMbox returns the locations of all messages and the number of bytes read.
+func indexMbox(file io.Reader) (messages []mboxMessage, size int64, err error) {
+	reader := bufio.NewReader(file)
+	var message *mboxMessage
+	// emptyLine is the length of the previous line if it was empty.
+	var emptyLine int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if isFromLine(line) {
+				if message != nil {
+					message.length = size - emptyLine - message.offset
+					message.end = size
+					messages = append(messages, *message)
+				}
+				message = &mboxMessage{
+					start:  size,
+					from:   line,
+					offset: size + int64(len(line)),
+				}
+			} else if message == nil && !isEmptyLine(line) {
+				return nil, 0, fmt.Errorf("%w: file does not start with a From line", ErrPermanent)
+			}
+			size += int64(len(line))
+			emptyLine = 0
+			if isEmptyLine(line) {
+				emptyLine = int64(len(line))
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, wrapFileError(err)
+		}
+	}
+	if message != nil {
+		message.length = max(size-emptyLine-message.offset, 0)
+		message.end = size
+		messages = append(messages, *message)
+	}
+	return messages, size, nil
+}
+
+// identify returns a UID derived from a hash of the content that is stable as long as the message is not deleted.
+// Neither the offsets, which change whenever messages before them are deleted, nor the Message-ID header alone,
+// which is shared by copies of a message, e.g. delivered to several aliases, are used.
+func (provider *mboxProvider) identify(file io.ReaderAt, message mboxMessage) (id string, size int64, err error) {
+	hash := sha1.New()
+	size, err = EncodeMessage(io.Discard, io.TeeReader(newMboxReader(file, message), hash), -1)
+	if err != nil {
+		return "", 0, wrapFileError(err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// mboxReader reads a message and removes one > from lines starting with >From, >>From and so on.
+// Source: https://www.loc.gov/preservation/digital/formats/fdd/fdd000385.shtml
+type mboxReader struct {
+	reader *bufio.Reader
+	line   []byte
+}
+
+func newMboxReader(file io.ReaderAt, message mboxMessage) *mboxReader {
+	return &mboxReader{
+		reader: bufio.NewReader(io.NewSectionReader(file, message.offset, message.length)),
+	}
+}
+
+func (reader *mboxReader) Read(b []byte) (n int, err error) {
+	if len(reader.line) == 0 {
+		line, err := reader.reader.ReadBytes('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		if line[0] == '>' && isFromLine(bytes.TrimLeft(line, ">")) {
+			line = line[1:]
+		}
+		reader.line = line
+	}
+	n = copy(b, reader.line)
+	reader.line = reader.line[n:]
+	return n, nil
+}
+
+type mboxFileReader struct {
+	*mboxReader
+	file   *os.File
+	unlock func()
+}
+
+func (reader *mboxFileReader) Close() error {
+	defer reader.unlock()
+	return reader.file.Close()
+}
+
+func (provider *mboxProvider) ListEmails(notNumbers []int) (emails map[int]*Email, err error) {
+	if provider.cache == nil {
+		err := provider.initCache()
+		if err != nil {
+			return nil, err
+		}
+	}
+	emails = make(map[int]*Email)
+	for number, email := range provider.cache.emails {
+		emails[number] = email
+	}
+	for _, notNumber := range notNumbers {
+		delete(emails, notNumber)
+	}
+	return emails, nil
+}
+
+func (provider *mboxProvider) GetEmail(number int, notNumbers []int) (email *Email, err error) {
+	emails, err := provider.ListEmails(notNumbers)
+	if err != nil {
+		return nil, err
+	}
+	if email, exists := emails[number]; exists {
+		return email, nil
+	}
+	return nil, fmt.Errorf("%w: %v does not exist", ErrNoSuchEmail, number)
+}
+
+func (provider *mboxProvider) GetEmailReader(number int, notNumbers []int) (reader io.ReadCloser, err error) {
+	if _, err := provider.GetEmail(number, notNumbers); err != nil {
+		return nil, err
+	}
+	message := provider.cache.messages[number]
+	// The file must not be closed while another session holds the fcntl lock.
+	unlock, err := lockPath(provider.path, false, provider.lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(provider.path)
+	if err != nil {
+		unlock()
+		return nil, wrapFileError(err)
+	}
+	if err := provider.verify(file, message); err != nil {
+		file.Close()
+		unlock()
+		return nil, err
+	}
+	return &mboxFileReader{
+		mboxReader: newMboxReader(file, message),
+		file:       file,
+		unlock:     unlock,
+	}, nil
+}
+
+// verify ensures that message is still located where it has been indexed. Appending messages does not move
+// other messages but deleting them via another client does.
+func (provider *mboxProvider) verify(file *os.File, messages ...mboxMessage) (err error) {
+	info, err := file.Stat()
+	if err != nil {
+		return wrapFileError(err)
+	}
+	modified := fmt.Errorf("%w: %v has been modified by another client", ErrTemporary, provider.path)
+	if !os.SameFile(info, provider.cache.info) || info.Size() < provider.cache.size {
+		return modified
+	}
+	for _, message := range messages {
+		from := make([]byte, len(message.from))
+		if _, err := file.ReadAt(from, message.start); err != nil {
+			return wrapFileError(err)
+		}
+		if !bytes.Equal(from, message.from) {
+			return modified
+		}
+	}
+	return nil
+}
+
+// DeleteEmails writes the remaining messages and everything that has been appended since the file was indexed
+// to a temporary file that replaces the mbox file. The file is locked using a dotlock and fcntl so that MDAs do
+// not append to the replaced file. Either all or none of the emails are deleted.
+func (provider *mboxProvider) DeleteEmails(numbers []int) (err error) {
+	deleted := make(map[int]bool)
+	var ids []string
+	for _, number := range numbers {
+		email, err := provider.GetEmail(number, nil)
+		if err != nil {
+			return err
+		}
+		deleted[number] = true
+		ids = append(ids, email.ID)
+	}
+	if err := provider.compact(deleted); err != nil {
+		return &DeleteError{
+			IDs: ids,
+			Err: err,
+		}
+	}
+	return nil
+}
+
+func (provider *mboxProvider) compact(deleted map[int]bool) (err error) {
+	unlockPath, err := lockPath(provider.path, true, provider.lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlockPath()
+	unlock, err := dotlock(provider.path, provider.lockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := os.OpenFile(provider.path, os.O_RDWR, 0)
+	if err != nil {
+		return wrapFileError(err)
+	}
+	defer file.Close()
+	if err := lockFile(file, true, provider.lockTimeout); err != nil {
+		return err
+	}
+	defer unlockFile(file)
+	var messages []mboxMessage
+	for number := 1; number <= len(provider.cache.messages); number++ {
+		messages = append(messages, provider.cache.messages[number])
+	}
+	if err := provider.verify(file, messages...); err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return wrapFileError(err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(provider.path), "."+filepath.Base(provider.path)+".*.tmp")
+	if err != nil {
+		return wrapFileError(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	var offset int64
+	for number, message := range messages {
+		if !deleted[number+1] {
+			continue
+		}
+		if _, err := io.Copy(tmp, io.NewSectionReader(file, offset, message.start-offset)); err != nil {
+			return wrapFileError(err)
+		}
+		offset = message.end
+	}
+	if _, err := io.Copy(tmp, io.NewSectionReader(file, offset, info.Size()-offset)); err != nil {
+		return wrapFileError(err)
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		return wrapFileError(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return wrapFileError(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return wrapFileError(err)
+	}
+	if err := os.Rename(tmp.Name(), provider.path); err != nil {
+		return wrapFileError(err)
+	}
+	provider.cache = nil
+	return nil
+}
+
+// retryLock calls lock until it succeeds or the timeout has elapsed.
+func retryLock(timeout time.Duration, lock func() (locked bool, err error)) (err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := lock()
+		if err != nil {
+			return wrapFileError(err)
+		}
+		if locked {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: timed out waiting for lock", ErrInUse)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// pathLocks excludes the sessions of this process from each other as fcntl locks are held per process, i.e. they
+// do not conflict within the process and closing any descriptor of the file releases them. Therefore, descriptors
+// of an mbox file are only opened and closed while holding its path lock.
+var pathLocks = struct {
+	mu    sync.Mutex
+	locks map[string]*sync.RWMutex
+}{
+	locks: make(map[string]*sync.RWMutex),
+}
+
+// lockPath acquires the path lock of the mbox file path shared by all sessions of this process.
+func lockPath(path string, exclusive bool, timeout time.Duration) (unlock func(), err error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	pathLocks.mu.Lock()
+	lock, exists := pathLocks.locks[path]
+	if !exists {
+		lock = &sync.RWMutex{}
+		pathLocks.locks[path] = lock
+	}
+	pathLocks.mu.Unlock()
+	tryLock, unlock := lock.TryRLock, lock.RUnlock
+	if exclusive {
+		tryLock, unlock = lock.TryLock, lock.Unlock
+	}
+	if err := retryLock(timeout, func() (locked bool, err error) {
+		return tryLock(), nil
+	}); err != nil {
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// dotlock creates the file path.lock that is respected by most MDAs and mail clients.
+func dotlock(path string, timeout time.Duration) (unlock func(), err error) {
+	lockPath := path + ".lock"
+	err = retryLock(timeout, func() (locked bool, err error) {
+		file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleDotlockAge {
+				os.Remove(lockPath)
+			}
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(file, "%v\n", os.Getpid())
+		return true, file.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		os.Remove(lockPath)
+	}, nil
+}
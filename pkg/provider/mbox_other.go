@@ -0,0 +1,31 @@
+//go:build !unix
+
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"os"
+	"time"
+)
+
+// lockFile does nothing as fcntl locks are not available. Deletions are still protected by the dotlock.
+func lockFile(file *os.File, exclusive bool, timeout time.Duration) (err error) {
+	return nil
+}
+
+func unlockFile(file *os.File) {}
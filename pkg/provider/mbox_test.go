@@ -0,0 +1,284 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMbox = "From alice@example.com Mon Jan  2 15:04:05 2006\n" +
+	"Message-ID: <a@example.com>\n" +
+	"\n" +
+	">From the start\n" +
+	">>From the archive\n" +
+	"\n" +
+	"From bob@example.com Tue Jan  3 15:04:05 2006\n" +
+	"Subject: b\n" +
+	"\n" +
+	"body\n" +
+	"\n" +
+	"From alice@example.com Wed Jan  4 15:04:05 2006\n" +
+	"Message-ID: <a@example.com>\n" +
+	"\n" +
+	"copy\n" +
+	"\n"
+
+func sha1Hex(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestMbox(t *testing.T, content string) (path string) {
+	path = filepath.Join(t.TempDir(), "mbox")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0640))
+	return path
+}
+
+func TestNewMboxProvider(t *testing.T) {
+	t.Parallel()
+	_, err := newMboxProvider("", newTestMbox(t, ""), Policy{})
+	assert.NoError(t, err)
+
+	_, err = newMboxProvider("", "", Policy{})
+	assert.ErrorIs(t, err, ErrPermanent)
+
+	_, err = newMboxProvider("", t.TempDir(), Policy{})
+	assert.ErrorIs(t, err, ErrPermanent)
+
+	_, err = newMboxProvider("", filepath.Join(t.TempDir(), "mbox"), Policy{})
+	assert.ErrorIs(t, err, ErrPermanent)
+}
+
+func TestMboxListEmails(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		content    string
+		notNumbers []int
+		want       map[int]*Email
+		wantErr    error
+	}{
+		{
+			name:    "empty",
+			content: "",
+			want:    map[int]*Email{},
+		},
+		{
+			name:    "messages",
+			content: testMbox,
+			want: map[int]*Email{
+				1: {ID: sha1Hex("Message-ID: <a@example.com>\n\nFrom the start\n>From the archive\n"), Size: 66},
+				2: {ID: sha1Hex("Subject: b\n\nbody\n"), Size: 20},
+				3: {ID: sha1Hex("Message-ID: <a@example.com>\n\ncopy\n"), Size: 37},
+			},
+		},
+		{
+			name: "identical copies",
+			content: "From alice@example.com Mon Jan  2 15:04:05 2006\nSubject: a\n\nbody\n\n" +
+				"From alice@example.com Mon Jan  2 15:04:05 2006\nSubject: a\n\nbody\n\n",
+			want: map[int]*Email{
+				1: {ID: sha1Hex("Subject: a\n\nbody\n"), Size: 20},
+				2: {ID: sha1Hex("Subject: a\n\nbody\n") + "-2", Size: 20},
+			},
+		},
+		{
+			name:       "notNumbers",
+			content:    testMbox,
+			notNumbers: []int{1, 3},
+			want: map[int]*Email{
+				2: {ID: sha1Hex("Subject: b\n\nbody\n"), Size: 20},
+			},
+		},
+		{
+			name:    "without final empty line",
+			content: "\nFrom alice@example.com Mon Jan  2 15:04:05 2006\r\nSubject: a\r\n\r\nbody",
+			want: map[int]*Email{
+				1: {ID: sha1Hex("Subject: a\r\n\r\nbody"), Size: 20},
+			},
+		},
+		{
+			name:    "no mbox",
+			content: "Subject: a\n\nbody\n",
+			wantErr: ErrPermanent,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			provider, err := newMboxProvider("", newTestMbox(t, tt.content), Policy{})
+			require.NoError(t, err)
+			got, err := provider.ListEmails(tt.notNumbers)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.EqualValues(t, tt.want, got)
+		})
+	}
+}
+
+func TestMboxGetEmailReader(t *testing.T) {
+	t.Parallel()
+	path := newTestMbox(t, testMbox)
+	provider, err := newMboxProvider("", path, Policy{})
+	require.NoError(t, err)
+
+	reader, err := provider.GetEmailReader(1, nil)
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.EqualValues(t, "Message-ID: <a@example.com>\n\nFrom the start\n>From the archive\n", string(content))
+
+	_, err = provider.GetEmailReader(2, []int{2})
+	assert.ErrorIs(t, err, ErrNoSuchEmail)
+
+	// Appending does not move the indexed messages.
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = file.WriteString("From carol@example.com Thu Jan  5 15:04:05 2006\nSubject: d\n\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	reader, err = provider.GetEmailReader(2, nil)
+	require.NoError(t, err)
+	content, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.NoError(t, reader.Close())
+	assert.EqualValues(t, "Subject: b\n\nbody\n", string(content))
+
+	// Another client deletes the first message.
+	require.NoError(t, os.WriteFile(path, []byte(testMbox[len("From alice"):]), 0640))
+	_, err = provider.GetEmailReader(2, nil)
+	assert.ErrorIs(t, err, ErrTemporary)
+}
+
+func TestMboxDeleteEmails(t *testing.T) {
+	t.Parallel()
+	path := newTestMbox(t, testMbox)
+	provider, err := newMboxProvider("", path, Policy{})
+	require.NoError(t, err)
+	_, err = provider.ListEmails(nil)
+	require.NoError(t, err)
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = file.WriteString("From carol@example.com Thu Jan  5 15:04:05 2006\nSubject: d\n\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	assert.NoError(t, provider.DeleteEmails([]int{1, 3}))
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.EqualValues(t, "From bob@example.com Tue Jan  3 15:04:05 2006\n"+
+		"Subject: b\n"+
+		"\n"+
+		"body\n"+
+		"\n"+
+		"From carol@example.com Thu Jan  5 15:04:05 2006\n"+
+		"Subject: d\n"+
+		"\n", string(content))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.EqualValues(t, os.FileMode(0640), info.Mode().Perm())
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	emails, err := provider.ListEmails(nil)
+	assert.NoError(t, err)
+	assert.Len(t, emails, 2)
+	assert.ErrorIs(t, provider.DeleteEmails([]int{3}), ErrNoSuchEmail)
+}
+
+func TestMboxDeleteEmailsUID(t *testing.T) {
+	t.Parallel()
+	path := newTestMbox(t, testMbox)
+	provider, err := newMboxProvider("", path, Policy{})
+	require.NoError(t, err)
+	emails, err := provider.ListEmails(nil)
+	require.NoError(t, err)
+	assert.NoError(t, provider.DeleteEmails([]int{1}))
+
+	// The copy with the same Message-ID keeps its UID once the first one is deleted.
+	provider, err = newMboxProvider("", path, Policy{})
+	require.NoError(t, err)
+	got, err := provider.ListEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, map[int]*Email{1: emails[2], 2: emails[3]}, got)
+}
+
+func TestMboxDeleteEmailsSession(t *testing.T) {
+	t.Parallel()
+	path := newTestMbox(t, testMbox)
+	reading, err := newMboxProvider("", path, Policy{})
+	require.NoError(t, err)
+	deleting, err := newMboxProvider("", path, Policy{})
+	require.NoError(t, err)
+	deleting.lockTimeout = 200 * time.Millisecond
+	_, err = deleting.ListEmails(nil)
+	require.NoError(t, err)
+
+	// fcntl locks do not exclude the sessions of the same process.
+	reader, err := reading.GetEmailReader(1, nil)
+	require.NoError(t, err)
+	err = deleting.DeleteEmails([]int{2})
+	var deleteErr *DeleteError
+	require.True(t, errors.As(err, &deleteErr))
+	assert.ErrorIs(t, deleteErr.Err, ErrInUse)
+
+	assert.NoError(t, reader.Close())
+	assert.NoError(t, deleting.DeleteEmails([]int{2}))
+}
+
+func TestMboxDeleteEmailsLocked(t *testing.T) {
+	t.Parallel()
+	path := newTestMbox(t, testMbox)
+	provider, err := newMboxProvider("", path, Policy{})
+	require.NoError(t, err)
+	provider.lockTimeout = 200 * time.Millisecond
+	_, err = provider.ListEmails(nil)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path+".lock", nil, 0600))
+	err = provider.DeleteEmails([]int{1})
+	var deleteErr *DeleteError
+	require.True(t, errors.As(err, &deleteErr))
+	assert.EqualValues(t, []string{sha1Hex("Message-ID: <a@example.com>\n\nFrom the start\n>From the archive\n")}, deleteErr.IDs)
+	assert.ErrorIs(t, deleteErr.Err, ErrInUse)
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.EqualValues(t, testMbox, string(content))
+
+	// Stale locks of crashed clients are removed.
+	modTime := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path+".lock", modTime, modTime))
+	assert.NoError(t, provider.DeleteEmails([]int{1}))
+	_, err = os.Stat(path + ".lock")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
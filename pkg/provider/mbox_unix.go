@@ -0,0 +1,52 @@
+//go:build unix
+
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockFile acquires an fcntl lock on the whole file as used by MDAs such as Postfix, procmail or Dovecot.
+func lockFile(file *os.File, exclusive bool, timeout time.Duration) (err error) {
+	lock := syscall.Flock_t{
+		Type:   syscall.F_RDLCK,
+		Whence: io.SeekStart,
+	}
+	if exclusive {
+		lock.Type = syscall.F_WRLCK
+	}
+	return retryLock(timeout, func() (locked bool, err error) {
+		err = syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock)
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+func unlockFile(file *os.File) {
+	syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &syscall.Flock_t{
+		Type:   syscall.F_UNLCK,
+		Whence: io.SeekStart,
+	})
+}
@@ -17,25 +17,49 @@
 package provider
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 )
 
 type noneProvider struct {
-	emails map[int]*Email
+	identity string
+	emails   map[int]*Email
+	policy   Policy
 }
 
 var _ Provider = &noneProvider{}
+var _ PolicyProvider = &noneProvider{}
+var _ IdentityProvider = &noneProvider{}
+var _ CapabilityProvider = &noneProvider{}
 
-func newNoneProvider(emails ...Email) (provider *noneProvider, err error) {
+func newNoneProvider(identity string, policy Policy, emails ...Email) (provider *noneProvider, err error) {
 	emailsMap := make(map[int]*Email)
 	for index, email := range emails {
+		if email.Payload != nil {
+			email.Size = email.Payload.WireSize()
+		}
 		emailsMap[index+1] = &email
 	}
 	return &noneProvider{
-		emails: emailsMap,
+		identity: identity,
+		emails:   emailsMap,
+		policy:   policy,
 	}, nil
 }
 
+func (provider *noneProvider) Policy() Policy {
+	return provider.policy
+}
+
+func (provider *noneProvider) Identity() string {
+	return provider.identity
+}
+
+func (provider *noneProvider) Capabilities() []string {
+	return []string{CapabilityTOP, CapabilityUIDL}
+}
+
 func (provider *noneProvider) ListEmails(notNumbers []int) (emails map[int]*Email, err error) {
 	emails = make(map[int]*Email)
 	for index, email := range provider.emails {
@@ -55,20 +79,22 @@ func (provider *noneProvider) GetEmail(number int, notNumbers []int) (email *Ema
 	if email, exists := emails[number]; exists {
 		return email, nil
 	}
-	return nil, fmt.Errorf("%v does not exist", number)
+	return nil, fmt.Errorf("%w: %v does not exist", ErrNoSuchEmail, number)
 }
 
-func (provider *noneProvider) GetEmailPayload(number int, notNumbers []int) (payload EmailPayload, err error) {
+func (provider *noneProvider) GetEmailReader(number int, notNumbers []int) (reader io.ReadCloser, err error) {
 	email, err := provider.GetEmail(number, notNumbers)
 	if err != nil {
 		return nil, err
 	}
-	return *email.Payload, nil
+	return io.NopCloser(bytes.NewReader(*email.Payload)), nil
 }
 
-func (provider *noneProvider) DeleteEmail(number int) (err error) {
-	if _, err := provider.GetEmail(number, nil); err != nil {
-		return err
+func (provider *noneProvider) DeleteEmails(numbers []int) (err error) {
+	for _, number := range numbers {
+		if _, err := provider.GetEmail(number, nil); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -17,10 +17,17 @@
 package provider
 
 import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,11 +36,17 @@ import (
 
 type ProviderCreator func(user, password string) (Provider, error)
 
+// APOPProviderCreator verifies the digest sent via APOP and is only available
+// for credential sources that can reveal the shared secret of a user.
+type APOPProviderCreator func(user, timestamp, digest string) (Provider, error)
+
 type Provider interface {
 	ListEmails(notNumbers []int) (emails map[int]*Email, err error)
 	GetEmail(number int, notNumbers []int) (email *Email, err error)
-	GetEmailPayload(number int, notNumbers []int) (payload EmailPayload, err error)
-	DeleteEmail(number int) (err error)
+	// GetEmailReader returns the raw message that has to be closed by the caller.
+	GetEmailReader(number int, notNumbers []int) (reader io.ReadCloser, err error)
+	// DeleteEmails attempts to delete all emails and returns a *DeleteError if some of them remain.
+	DeleteEmails(numbers []int) (err error)
 }
 
 type S3Bucket struct {
@@ -43,59 +56,253 @@ type S3Bucket struct {
 	Region             string `json:"region,omitempty"`
 	Bucket             string `json:"bucket,omitempty"`
 	Prefix             string `json:"prefix,omitempty"`
+	// MaxEmails limits the number of emails in the maildrop; 0 means no limit.
+	MaxEmails int `json:"maxEmails,omitempty"`
+	// Order is the order in which emails are numbered, defaults to OrderKey so that existing maildrops are not renumbered.
+	Order string `json:"order,omitempty"`
+	// Endpoint is the URL of an S3-compatible service such as MinIO; defaults to AWS.
+	Endpoint string `json:"endpoint,omitempty"`
+	// ForcePathStyle addresses the bucket in the path instead of the host name as most S3-compatible services require.
+	ForcePathStyle bool `json:"forcePathStyle,omitempty"`
+	// CABundle contains PEM encoded certificates that are trusted instead of the system ones.
+	CABundle string `json:"caBundle,omitempty"`
+	// DisableSSL uses http for endpoints without a scheme.
+	DisableSSL bool `json:"disableSSL,omitempty"`
+	// RoleARN is assumed with the verified identity of the user as session name if set,
+	// i.e. the subject of the JWT or the user checked by the HTTP endpoint or the static credentials.
+	RoleARN    string `json:"roleARN,omitempty"`
+	ExternalID string `json:"externalID,omitempty"`
+	// STSEndpoint is the URL of an STS-compatible service used to assume RoleARN; defaults to AWS.
+	STSEndpoint string `json:"stsEndpoint,omitempty"`
+	// DeletePolicy determines what happens to deleted emails, defaults to DeletePolicyDelete.
+	DeletePolicy string `json:"deletePolicy,omitempty"`
+	// ArchiveBucket and ArchivePrefix are the destination of DeletePolicyArchive. ArchiveBucket defaults to Bucket.
+	ArchiveBucket string `json:"archiveBucket,omitempty"`
+	ArchivePrefix string `json:"archivePrefix,omitempty"`
+	// ArchiveStorageClass is the storage class used by DeletePolicyStorageClass, e.g. GLACIER.
+	ArchiveStorageClass string `json:"archiveStorageClass,omitempty"`
+	// WireSizeTags reads the wire sizes of the emails from the pop3-wire-size tags and stores computed ones there,
+	// which requires s3:GetObjectTagging and s3:PutObjectTagging. Tags are never written by DeletePolicyTag.
+	WireSizeTags bool `json:"wireSizeTags,omitempty"`
+}
+
+// Policy is announced to clients via the EXPIRE and LOGIN-DELAY capabilities. Unspecified values
+// fall back to the defaults of the handler.
+// Source: https://www.ietf.org/rfc/rfc2449.txt
+type Policy struct {
+	// Expire is the number of days messages are retained on the server or NEVER.
+	Expire string `json:"expire,omitempty"`
+	// LoginDelay is the minimum number of seconds between two logins of a user.
+	LoginDelay int `json:"loginDelay,omitempty"`
+}
+
+// PolicyProvider is implemented by providers that know the policy of their user.
+type PolicyProvider interface {
+	Policy() Policy
+}
+
+func (policy Policy) Validate() error {
+	if policy.Expire != "" && policy.Expire != "NEVER" {
+		if days, err := strconv.Atoi(policy.Expire); err != nil || days < 0 {
+			return fmt.Errorf("%w: expire must be either a number of days or NEVER", ErrPermanent)
+		}
+	}
+	if policy.LoginDelay < 0 {
+		return fmt.Errorf("%w: loginDelay must not be negative", ErrPermanent)
+	}
+	return nil
+}
+
+// WithDefaults returns policy with the unspecified values taken from defaults.
+func (policy Policy) WithDefaults(defaults Policy) Policy {
+	if policy.Expire == "" {
+		policy.Expire = defaults.Expire
+	}
+	if policy.LoginDelay == 0 {
+		policy.LoginDelay = defaults.LoginDelay
+	}
+	return policy
+}
+
+// The optional capabilities that depend on the provider.
+// Source: https://www.ietf.org/rfc/rfc2449.txt
+const (
+	CapabilityTOP  = "TOP"
+	CapabilityUIDL = "UIDL"
+)
+
+// CapabilityProvider is implemented by providers to declare which of the optional capabilities,
+// i.e. TOP and UIDL, they support. Other providers are assumed to support all of them.
+type CapabilityProvider interface {
+	Capabilities() []string
+}
+
+// UnsizedProvider is implemented by providers that need to read the emails to compute their exact sizes.
+// It serves the commands that do not report sizes, i.e. UIDL and DELE.
+type UnsizedProvider interface {
+	// ListUnsizedEmails returns the emails like ListEmails without computing their exact sizes.
+	ListUnsizedEmails(notNumbers []int) (emails map[int]*Email, err error)
+	// GetUnsizedEmail returns the email like GetEmail without computing its exact size.
+	GetUnsizedEmail(number int, notNumbers []int) (email *Email, err error)
+}
+
+// IdentityProvider is implemented by providers to return the verified identity of their user, e.g. the subject
+// of the JWT, as the user supplied by the client is not checked by all credential sources.
+type IdentityProvider interface {
+	Identity() string
+}
+
+// TopProvider is implemented by providers that can serve TOP without reading the whole message.
+type TopProvider interface {
+	// GetEmailTopReader returns a reader like GetEmailReader that only fetches as much of the
+	// message as is actually read.
+	GetEmailTopReader(number int, notNumbers []int) (reader io.ReadCloser, err error)
 }
 
 type JWTClaims struct {
 	jwt.StandardClaims
 	Provider string `json:"provider,omitempty"`
 	S3Bucket
+	// Maildir is the path of the Maildir of the user if Provider is maildir.
+	Maildir string `json:"maildir,omitempty"`
+	// Mbox is the path of the mbox file of the user if Provider is mbox.
+	Mbox string `json:"mbox,omitempty"`
+	Policy
+}
+
+// newProvider creates the provider selected by name as received via JWT or HTTP basic auth.
+// identity is the verified identity of the user, e.g. used as role session name and to enforce the login delay.
+func newProvider(identity, name string, bucket S3Bucket, maildir, mbox string, policy Policy) (Provider, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	switch true {
+	case strings.EqualFold(name, "none"):
+		return newNoneProvider(identity, policy)
+	case strings.EqualFold(name, "demo"):
+		return newNoneProvider(identity, policy, DemoEmail)
+	case strings.EqualFold(name, "maildir"):
+		return newMaildirProvider(identity, maildir, policy)
+	case strings.EqualFold(name, "mbox"):
+		return newMboxProvider(identity, mbox, policy)
+	case name == "" || strings.EqualFold(name, "s3"):
+		return openS3Provider(identity, bucket, policy)
+	}
+	return nil, fmt.Errorf("%w: provider must be either be '', 'none', 'demo', 'maildir', 'mbox' or 's3'", ErrPermanent)
 }
 
 type StaticCredentials struct {
 	User     string
 	Password string
+	// Users holds additional pairs of user and password, e.g. read via ReadHtpasswdFile.
+	Users    map[string]string
 	S3Bucket *S3Bucket
+	// Maildir is the path of a Maildir that is served if S3Bucket is not set.
+	Maildir string
+	// Mbox is the path of an mbox file that is served if neither S3Bucket nor Maildir are set.
+	Mbox string
+}
+
+func (staticCreds StaticCredentials) lookup(user string) (password string, exists bool) {
+	if staticCreds.User != "" && user == staticCreds.User {
+		return staticCreds.Password, true
+	}
+	password, exists = staticCreds.Users[user]
+	return password, exists
+}
+
+func (staticCreds StaticCredentials) newProvider(user string) (Provider, error) {
+	if staticCreds.S3Bucket != nil {
+		return openS3Provider(user, *staticCreds.S3Bucket, Policy{})
+	}
+	if staticCreds.Maildir != "" {
+		return newMaildirProvider(user, staticCreds.Maildir, Policy{})
+	}
+	if staticCreds.Mbox != "" {
+		return newMboxProvider(user, staticCreds.Mbox, Policy{})
+	}
+	return newNoneProvider(user, Policy{})
 }
 
 func NewStaticCredentialsProviderCreator(staticCreds StaticCredentials) ProviderCreator {
 	return func(user, password string) (Provider, error) {
-		if user == staticCreds.User && password == staticCreds.Password {
-			if staticCreds.S3Bucket != nil {
-				return newS3Provider(*staticCreds.S3Bucket)
-			}
-			return newNoneProvider()
+		if secret, exists := staticCreds.lookup(user); exists &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(secret)) == 1 {
+			return staticCreds.newProvider(user)
+		}
+		return nil, fmt.Errorf("%w: credentials do not match user/password", ErrAuth)
+	}
+}
+
+func NewStaticCredentialsAPOPProviderCreator(staticCreds StaticCredentials) APOPProviderCreator {
+	return func(user, timestamp, digest string) (Provider, error) {
+		if secret, exists := staticCreds.lookup(user); exists && verifyAPOPDigest(timestamp, secret, digest) {
+			return staticCreds.newProvider(user)
+		}
+		return nil, fmt.Errorf("%w: credentials do not match user/digest", ErrAuth)
+	}
+}
+
+// verifyAPOPDigest checks that digest is the MD5 digest of timestamp followed by secret.
+// Source: https://www.ietf.org/rfc/rfc1939.txt
+func verifyAPOPDigest(timestamp, secret, digest string) bool {
+	sum := md5.Sum([]byte(timestamp + secret))
+	want := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(digest))) == 1
+}
+
+// ReadHtpasswdFile reads lines of the form user:password. As APOP requires the shared secret,
+// passwords must be stored in plaintext. Empty lines and lines starting with # are ignored.
+func ReadHtpasswdFile(path string) (users map[string]string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	users = make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, password, found := strings.Cut(line, ":")
+		if !found || user == "" || password == "" {
+			return nil, fmt.Errorf("%v:%v: expected user:password", path, number)
+		}
+		if strings.HasPrefix(password, "$") || strings.HasPrefix(password, "{SHA}") {
+			return nil, fmt.Errorf("%v:%v: hashed passwords are not supported", path, number)
 		}
-		return nil, errors.New("credentials do not match user/password")
+		users[user] = password
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
 }
 
 func NewJWTProviderCreator(jwtSecret string) ProviderCreator {
-	return func(_, password string) (Provider, error) {
+	return func(user, password string) (Provider, error) {
 		claims := JWTClaims{}
 		if _, err := jwt.ParseWithClaims(password, &claims, func(token *jwt.Token) (interface{}, error) {
 			return []byte(jwtSecret), nil
 		}); err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %v", ErrAuth, err)
 		}
-		switch true {
-		case strings.EqualFold(claims.Provider, "none"):
-			return newNoneProvider()
-		case strings.EqualFold(claims.Provider, "demo"):
-			return newNoneProvider(DemoEmail)
-		case claims.Provider == "" || strings.EqualFold(claims.Provider, "s3"):
-			return newS3Provider(S3Bucket{
-				AWSAccessKeyID:     claims.AWSAccessKeyID,
-				AWSSecretAccessKey: claims.AWSSecretAccessKey,
-				AWSSessionToken:    claims.AWSSessionToken,
-				Region:             claims.Region,
-				Bucket:             claims.Bucket,
-				Prefix:             claims.Prefix,
-			})
-		}
-		return nil, errors.New("provider must be either be '', 'none', 'demo' or 's3'")
+		return newProvider(jwtIdentity(password, claims), claims.Provider, claims.S3Bucket, claims.Maildir, claims.Mbox, claims.Policy)
 	}
 }
 
+// jwtIdentity returns the subject of the JWT as the user sent along with it is not checked.
+// Tokens without subject are identified by their hash.
+func jwtIdentity(token string, claims JWTClaims) string {
+	if claims.Subject != "" {
+		return claims.Subject
+	}
+	sum := sha1.Sum([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func NewHTTPBasicAuthProviderCreator(timeout time.Duration, url string) ProviderCreator {
 	client := &http.Client{
 		Timeout: timeout,
@@ -103,21 +310,32 @@ func NewHTTPBasicAuthProviderCreator(timeout time.Duration, url string) Provider
 	return func(user, password string) (Provider, error) {
 		req, err := http.NewRequest("GET", url, nil)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %v", ErrPermanent, err)
 		}
 		req.SetBasicAuth(user, password)
 		res, err := client.Do(req)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %v", ErrTemporary, err)
 		}
 		defer res.Body.Close()
-		if res.StatusCode != 200 {
-			return nil, fmt.Errorf("received status code %v", res.StatusCode)
+		switch {
+		case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+			return nil, fmt.Errorf("%w: received status code %v", ErrAuth, res.StatusCode)
+		case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+			return nil, fmt.Errorf("%w: received status code %v", ErrTemporary, res.StatusCode)
+		case res.StatusCode != 200:
+			return nil, fmt.Errorf("%w: received status code %v", ErrPermanent, res.StatusCode)
+		}
+		var body struct {
+			Provider string `json:"provider,omitempty"`
+			S3Bucket
+			Maildir string `json:"maildir,omitempty"`
+			Mbox    string `json:"mbox,omitempty"`
+			Policy
 		}
-		var bucket S3Bucket
-		if err := json.NewDecoder(res.Body).Decode(&bucket); err != nil {
-			return nil, err
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPermanent, err)
 		}
-		return newS3Provider(bucket)
+		return newProvider(user, body.Provider, body.S3Bucket, body.Maildir, body.Mbox, body.Policy)
 	}
 }
@@ -0,0 +1,227 @@
+/*
+   Copyright 2022 Markus Hinz
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyAPOPDigest(t *testing.T) {
+	t.Parallel()
+	type args struct {
+		timestamp string
+		secret    string
+		digest    string
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{
+			name: "RFC 1939 example",
+			args: args{
+				timestamp: "<1896.697170952@dbc.mtview.ca.us>",
+				secret:    "tanstaaf",
+				digest:    "c4c9334bac560ecc979e58001b3e22fb",
+			},
+			want: true,
+		},
+		{
+			name: "upper case",
+			args: args{
+				timestamp: "<1896.697170952@dbc.mtview.ca.us>",
+				secret:    "tanstaaf",
+				digest:    "C4C9334BAC560ECC979E58001B3E22FB",
+			},
+			want: true,
+		},
+		{
+			name: "wrong secret",
+			args: args{
+				timestamp: "<1896.697170952@dbc.mtview.ca.us>",
+				secret:    "changeit",
+				digest:    "c4c9334bac560ecc979e58001b3e22fb",
+			},
+		},
+		{
+			name: "wrong timestamp",
+			args: args{
+				timestamp: "<1896.697170953@dbc.mtview.ca.us>",
+				secret:    "tanstaaf",
+				digest:    "c4c9334bac560ecc979e58001b3e22fb",
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got := verifyAPOPDigest(tt.args.timestamp, tt.args.secret, tt.args.digest)
+			assert.EqualValues(t, tt.want, got)
+		})
+	}
+}
+
+func TestReadHtpasswdFile(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:    "users",
+			content: "# comment\njane:secret\n\njohn:tan:staaf\n",
+			want: map[string]string{
+				"jane": "secret",
+				"john": "tan:staaf",
+			},
+		},
+		{
+			name:    "missing password",
+			content: "jane\n",
+			wantErr: true,
+		},
+		{
+			name:    "hashed password",
+			content: "jane:$apr1$x3Uh1l5q$H9fBCMz8bd5bZoM4A9u0S.\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "htpasswd")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0600))
+			got, err := ReadHtpasswdFile(path)
+			assert.EqualValues(t, tt.wantErr, err != nil)
+			if !tt.wantErr {
+				assert.EqualValues(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "days", policy: Policy{Expire: "0", LoginDelay: 60}},
+		{name: "never", policy: Policy{Expire: "NEVER"}},
+		{name: "invalid expire", policy: Policy{Expire: "soon"}, wantErr: true},
+		{name: "negative expire", policy: Policy{Expire: "-1"}, wantErr: true},
+		{name: "negative login delay", policy: Policy{LoginDelay: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.policy.Validate()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrPermanent)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	assert.EqualValues(t, Policy{Expire: "NEVER", LoginDelay: 60},
+		Policy{Expire: "NEVER"}.WithDefaults(Policy{Expire: "30", LoginDelay: 60}))
+}
+
+func TestJWTIdentity(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		token  string
+		claims JWTClaims
+		want   string
+	}{
+		{
+			name:   "subject",
+			token:  "token",
+			claims: JWTClaims{StandardClaims: jwt.StandardClaims{Subject: "jane@example.com"}},
+			want:   "jane@example.com",
+		},
+		{
+			name:  "without subject",
+			token: "token",
+			want:  "ee977806d7286510da8b9a7492ba58e2484c0ecc",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.EqualValues(t, tt.want, jwtIdentity(tt.token, tt.claims))
+		})
+	}
+}
+
+func TestNewProvider(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		provider string
+		maildir  string
+		policy   Policy
+		wantErr  error
+	}{
+		{name: "none", provider: "none"},
+		{name: "demo", provider: "DEMO"},
+		{name: "maildir", provider: "maildir", maildir: "maildir"},
+		{name: "maildir without path", provider: "maildir", wantErr: ErrPermanent},
+		{name: "mbox without path", provider: "mbox", wantErr: ErrPermanent},
+		{name: "unknown", provider: "imap", wantErr: ErrPermanent},
+		{name: "invalid policy", provider: "none", policy: Policy{LoginDelay: -1}, wantErr: ErrPermanent},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			maildir := tt.maildir
+			if maildir != "" {
+				maildir = t.TempDir()
+				require.NoError(t, os.Mkdir(filepath.Join(maildir, "cur"), 0700))
+				require.NoError(t, os.Mkdir(filepath.Join(maildir, "new"), 0700))
+			}
+			provider, err := newProvider("user", tt.provider, S3Bucket{}, maildir, "", tt.policy)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				require.Implements(t, (*CapabilityProvider)(nil), provider)
+				assert.EqualValues(t, []string{"TOP", "UIDL"}, provider.(CapabilityProvider).Capabilities())
+				require.Implements(t, (*IdentityProvider)(nil), provider)
+				assert.EqualValues(t, "user", provider.(IdentityProvider).Identity())
+			}
+		})
+	}
+}
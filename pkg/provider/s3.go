@@ -17,81 +17,692 @@
 package provider
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
+// maxDeleteObjects is the maximum number of keys per DeleteObjects request.
+const maxDeleteObjects = 1000
+
+// maxTagRequests limits the concurrent GetObjectTagging requests while listing the objects.
+const maxTagRequests = 16
+
+// maxSizeRequests limits the objects that are downloaded concurrently to compute their wire sizes.
+const maxSizeRequests = 16
+
+// maxDateRequests limits the concurrent ranged GetObject requests that read the Date headers.
+const maxDateRequests = 16
+
+// maxCachedObjects bounds the number of objects an objectCache remembers.
+const maxCachedObjects = 100000
+
+// deletedObjectsTTL is the time after which the tags of deleted objects are requested again,
+// e.g. in case the deleted tag has been removed to restore a message.
+const deletedObjectsTTL = 10 * time.Minute
+
+// initialRangeSize is the size of the first range requested to serve TOP which is sufficient for most headers.
+const initialRangeSize = 16 * 1024
+
+// The tag that marks objects as deleted if the delete policy is DeletePolicyTag.
+const (
+	deletedTagKey   = "pop3-deleted"
+	deletedTagValue = "true"
+)
+
+// wireSizeTagKey is the tag that stores the wire size of an object. Writers may set it when storing the object;
+// the server only sets it if enabled. S3 removes the tags when an object is overwritten.
+const wireSizeTagKey = "pop3-wire-size"
+
+// maxObjectTags is the maximum number of tags per object.
+const maxObjectTags = 10
+
 type s3Cache struct {
 	emails map[int]*Email
+	// unsized holds the ETags of the emails whose size is still the raw object size.
+	unsized map[int]string
+	// tags holds the tags of the unsized emails if they have been read while listing.
+	tags  map[int][]*s3.Tag
+	etags map[int]string
+}
+
+// objectCache caches a value per object for ttl or, if ttl is 0, for the lifetime of the process.
+// The ETag is part of the key as it changes with the content. The cache is cleared once it holds maxCachedObjects.
+type objectCache[V any] struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	values map[string]cachedValue[V]
 }
 
+type cachedValue[V any] struct {
+	value V
+	added time.Time
+}
+
+func newObjectCache[V any](ttl time.Duration) *objectCache[V] {
+	return &objectCache[V]{
+		ttl:    ttl,
+		values: make(map[string]cachedValue[V]),
+	}
+}
+
+func (cache *objectCache[V]) get(key string) (value V, exists bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cached, exists := cache.values[key]
+	if exists && cache.ttl > 0 && time.Since(cached.added) >= cache.ttl {
+		delete(cache.values, key)
+		return value, false
+	}
+	return cached.value, exists
+}
+
+func (cache *objectCache[V]) add(key string, value V) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.values) >= maxCachedObjects {
+		cache.values = make(map[string]cachedValue[V])
+	}
+	cache.values[key] = cachedValue[V]{value: value, added: time.Now()}
+}
+
+// wireSizes is shared by the providers created by newS3Provider so that the tags holding the wire sizes
+// are not requested again in every session.
+var wireSizes = newObjectCache[int64](0)
+
+// dates caches the Date headers of objects as reading them requires a request per object.
+var dates = newObjectCache[time.Time](0)
+
+// deletedObjects caches the objects that are tagged as deleted. It is shared by the providers created by
+// newS3Provider so that the tags of deleted objects are not requested again in every session. Objects that
+// are not tagged are not cached as they may be tagged by another instance of the server.
+var deletedObjects = newObjectCache[bool](deletedObjectsTTL)
+
+// The orders in which emails can be numbered.
+const (
+	OrderLastModified = "last-modified"
+	OrderKey          = "key"
+	OrderDate         = "date"
+)
+
+// The delete policies that determine what happens to deleted emails. Except for DeletePolicyDelete,
+// the messages are kept, e.g. to comply with retention requirements, but are not listed anymore.
+const (
+	// DeletePolicyDelete removes the objects.
+	DeletePolicyDelete = "delete"
+	// DeletePolicyArchive copies the objects to the archive bucket and prefix before removing them.
+	DeletePolicyArchive = "archive"
+	// DeletePolicyTag tags the objects with pop3-deleted=true.
+	DeletePolicyTag = "tag"
+	// DeletePolicyStorageClass moves the objects to the archive storage class.
+	DeletePolicyStorageClass = "storage-class"
+)
+
 type s3Provider struct {
-	bucket     string
-	prefix     string
-	client     s3iface.S3API
-	downloader s3manageriface.DownloaderAPI
-	cache      *s3Cache
+	identity string
+	// endpoint and region identify the service of the bucket in the keys of the caches shared by all providers.
+	endpoint string
+	region   string
+	bucket   string
+	prefix   string
+	client   s3iface.S3API
+	cache    *s3Cache
+	policy   Policy
+	// maxEmails limits the number of emails in the maildrop; 0 means no limit.
+	maxEmails           int
+	order               string
+	deletePolicy        string
+	archiveBucket       string
+	archivePrefix       string
+	archiveStorageClass string
+	// wireSizeTags reads the wire sizes from the tags of the objects and stores computed ones there.
+	wireSizeTags bool
+	// sizes caches the wire sizes of the objects if not nil.
+	sizes *objectCache[int64]
+	// deleted caches the objects tagged as deleted if not nil.
+	deleted *objectCache[bool]
 }
 
 var _ Provider = &s3Provider{}
+var _ PolicyProvider = &s3Provider{}
+var _ IdentityProvider = &s3Provider{}
+var _ CapabilityProvider = &s3Provider{}
+var _ TopProvider = &s3Provider{}
+var _ UnsizedProvider = &s3Provider{}
 
-func newS3Provider(bucket S3Bucket) (provider *s3Provider, err error) {
-	client, downloader, err := initClientAndDownloader(bucket.AWSAccessKeyID, bucket.AWSSecretAccessKey, bucket.AWSSessionToken, bucket.Region)
+func newS3Provider(identity string, bucket S3Bucket, policy Policy) (provider *s3Provider, err error) {
+	client, err := initClient(identity, bucket)
 	if err != nil {
 		return nil, err
 	}
-	prefix := bucket.Prefix
-	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		prefix += "/"
+	order := bucket.Order
+	switch order {
+	case "":
+		order = OrderKey
+	case OrderLastModified, OrderKey, OrderDate:
+	default:
+		return nil, fmt.Errorf("%w: order must be either %q, %q or %q", ErrPermanent, OrderLastModified, OrderKey, OrderDate)
+	}
+	prefix := withSlash(bucket.Prefix)
+	archiveBucket := bucket.ArchiveBucket
+	if archiveBucket == "" {
+		archiveBucket = bucket.Bucket
+	}
+	archivePrefix := withSlash(bucket.ArchivePrefix)
+	deletePolicy := bucket.DeletePolicy
+	switch deletePolicy {
+	case "":
+		deletePolicy = DeletePolicyDelete
+	case DeletePolicyDelete, DeletePolicyTag:
+	case DeletePolicyArchive:
+		// Archived emails would be listed again.
+		if archiveBucket == bucket.Bucket && strings.HasPrefix(archivePrefix, prefix) {
+			return nil, fmt.Errorf("%w: archive prefix must not be below prefix %q", ErrPermanent, prefix)
+		}
+	case DeletePolicyStorageClass:
+		if bucket.ArchiveStorageClass == "" || bucket.ArchiveStorageClass == s3.StorageClassStandard {
+			return nil, fmt.Errorf("%w: archive storage class must be specified and differ from %v", ErrPermanent, s3.StorageClassStandard)
+		}
+	default:
+		return nil, fmt.Errorf("%w: delete policy must be either %q, %q, %q or %q", ErrPermanent, DeletePolicyDelete, DeletePolicyArchive, DeletePolicyTag, DeletePolicyStorageClass)
 	}
 	return &s3Provider{
-		bucket:     bucket.Bucket,
-		prefix:     prefix,
-		client:     client,
-		downloader: downloader,
+		identity:            identity,
+		endpoint:            bucket.Endpoint,
+		region:              bucket.Region,
+		bucket:              bucket.Bucket,
+		prefix:              prefix,
+		client:              client,
+		policy:              policy,
+		maxEmails:           bucket.MaxEmails,
+		order:               order,
+		deletePolicy:        deletePolicy,
+		archiveBucket:       archiveBucket,
+		archivePrefix:       archivePrefix,
+		archiveStorageClass: bucket.ArchiveStorageClass,
+		wireSizeTags:        bucket.WireSizeTags,
+		sizes:               wireSizes,
+		deleted:             deletedObjects,
 	}, nil
 }
 
-func initClientAndDownloader(awsAccessKeyID, awsSecretAccessKey, awsSessionToken, region string) (client *s3.S3, downloader *s3manager.Downloader, err error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(awsAccessKeyID, awsSecretAccessKey, awsSessionToken),
-	})
+// openS3Provider creates the provider like newS3Provider. If the number of emails is limited, the maildrop is
+// listed right away so that a maildrop that is too large is rejected during authentication.
+func openS3Provider(identity string, bucket S3Bucket, policy Policy) (provider *s3Provider, err error) {
+	provider, err = newS3Provider(identity, bucket, policy)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if provider.maxEmails > 0 {
+		if err := provider.initCache(); err != nil {
+			return nil, err
+		}
+	}
+	return provider, nil
+}
+
+func withSlash(prefix string) string {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+func (provider *s3Provider) Policy() Policy {
+	return provider.policy
+}
+
+func (provider *s3Provider) Identity() string {
+	return provider.identity
+}
+
+// Capabilities includes TOP as it is served by ranged reads of the first bytes of the email.
+func (provider *s3Provider) Capabilities() []string {
+	return []string{CapabilityTOP, CapabilityUIDL}
+}
+
+// initClient uses the static credentials of bucket or falls back to the default credential chain, e.g. to
+// use the role of an ECS task or an EKS service account. If a role is given, it is assumed with identity as session name.
+func initClient(identity string, bucket S3Bucket) (client *s3.S3, err error) {
+	options := session.Options{
+		Config: aws.Config{
+			Region:           aws.String(bucket.Region),
+			S3ForcePathStyle: aws.Bool(bucket.ForcePathStyle),
+			DisableSSL:       aws.Bool(bucket.DisableSSL),
+		},
+	}
+	if bucket.AWSAccessKeyID != "" || bucket.AWSSecretAccessKey != "" {
+		options.Config.Credentials = credentials.NewStaticCredentials(bucket.AWSAccessKeyID, bucket.AWSSecretAccessKey, bucket.AWSSessionToken)
+	}
+	if bucket.CABundle != "" {
+		options.CustomCABundle = strings.NewReader(bucket.CABundle)
+	}
+	sess, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPermanent, err)
+	}
+	s3Config := aws.NewConfig()
+	if bucket.Endpoint != "" {
+		s3Config.Endpoint = aws.String(bucket.Endpoint)
+	}
+	if bucket.RoleARN != "" {
+		stsConfig := aws.NewConfig()
+		if bucket.STSEndpoint != "" {
+			stsConfig.Endpoint = aws.String(bucket.STSEndpoint)
+		}
+		s3Config.Credentials = stscreds.NewCredentialsWithClient(sts.New(sess, stsConfig), bucket.RoleARN, func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = roleSessionName(identity)
+			if bucket.ExternalID != "" {
+				provider.ExternalID = aws.String(bucket.ExternalID)
+			}
+		})
+	}
+	return s3.New(sess, s3Config), nil
+}
+
+// roleSessionName replaces the characters of user that are not allowed in role session names
+// and ensures the required length of 2 to 64 characters.
+// Source: https://docs.aws.amazon.com/STS/latest/APIReference/API_AssumeRole.html
+func roleSessionName(user string) string {
+	name := []rune(strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_+=,.@-", r)) {
+			return r
+		}
+		return '-'
+	}, user))
+	if len(name) > 64 {
+		name = name[:64]
 	}
-	return s3.New(sess), s3manager.NewDownloader(sess), nil
+	for len(name) < 2 {
+		name = append(name, '-')
+	}
+	return string(name)
 }
 
+// initCache lists all objects below the prefix page by page and numbers them in the configured order.
+// Objects deleted according to the delete policy are skipped. It fails if there are more than maxEmails.
 func (provider *s3Provider) initCache() (err error) {
-	res, err := provider.client.ListObjectsV2(&s3.ListObjectsV2Input{
+	var objects []*s3.Object
+	tags := make(map[string][]*s3.Tag)
+	input := &s3.ListObjectsV2Input{
 		Bucket: aws.String(provider.bucket),
 		Prefix: aws.String(provider.prefix),
-	})
-	if err != nil {
+	}
+	for {
+		res, err := provider.client.ListObjectsV2(input)
+		if err != nil {
+			return wrapS3Error(err)
+		}
+		visible, err := provider.filterHidden(res.Contents, tags)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, visible...)
+		if provider.maxEmails > 0 && len(objects) > provider.maxEmails {
+			return fmt.Errorf("%w: more than %v emails below %v/%v", ErrMaildropTooLarge, provider.maxEmails, provider.bucket, provider.prefix)
+		}
+		if !aws.BoolValue(res.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = res.NextContinuationToken
+	}
+	if err := provider.sortObjects(objects); err != nil {
 		return err
 	}
-	provider.cache = &s3Cache{
-		emails: make(map[int]*Email),
+	cache := &s3Cache{
+		emails:  make(map[int]*Email),
+		unsized: make(map[int]string),
+		tags:    make(map[int][]*s3.Tag),
+		etags:   make(map[int]string),
 	}
-	for index, item := range res.Contents {
-		provider.cache.emails[index+1] = &Email{
+	for index, item := range objects {
+		number := index + 1
+		cache.emails[number] = &Email{
 			ID:   strings.TrimPrefix(*item.Key, provider.prefix),
 			Size: *item.Size,
 		}
+		etag := aws.StringValue(item.ETag)
+		cache.etags[number] = etag
+		if size, exists := provider.cachedWireSize(*item.Key, etag); exists {
+			cache.emails[number].Size = size
+		} else if size, found := wireSizeTag(tags[*item.Key]); found {
+			cache.emails[number].Size = size
+			provider.cacheWireSize(*item.Key, etag, size)
+		} else {
+			cache.unsized[number] = etag
+			if objectTags, read := tags[*item.Key]; read {
+				cache.tags[number] = objectTags
+			}
+		}
+	}
+	provider.cache = cache
+	return nil
+}
+
+// filterHidden returns the objects that have not been deleted according to the delete policy.
+// If the tags of the objects are required, up to maxTagRequests of them are requested concurrently
+// and those of the visible objects are added to tags so that they are not requested again.
+func (provider *s3Provider) filterHidden(objects []*s3.Object, tags map[string][]*s3.Tag) (visible []*s3.Object, err error) {
+	hidden := make([]bool, len(objects))
+	objectTags := make([][]*s3.Tag, len(objects))
+	errs := make([]error, len(objects))
+	if provider.deletePolicy == DeletePolicyTag {
+		var wg sync.WaitGroup
+		semaphore := make(chan struct{}, maxTagRequests)
+		for index, object := range objects {
+			wg.Add(1)
+			semaphore <- struct{}{}
+			go func(index int, object *s3.Object) {
+				defer wg.Done()
+				hidden[index], objectTags[index], errs[index] = provider.isHidden(object)
+				<-semaphore
+			}(index, object)
+		}
+		wg.Wait()
+	} else {
+		for index, object := range objects {
+			hidden[index], objectTags[index], errs[index] = provider.isHidden(object)
+		}
+	}
+	for index, object := range objects {
+		if errs[index] != nil {
+			return nil, errs[index]
+		}
+		if !hidden[index] {
+			visible = append(visible, object)
+			if objectTags[index] != nil {
+				tags[*object.Key] = objectTags[index]
+			}
+		}
+	}
+	return visible, nil
+}
+
+// isHidden reports whether object has been deleted according to the delete policy without being removed.
+// The tags are returned if they had to be read, e.g. so that the wire size is not requested separately.
+func (provider *s3Provider) isHidden(object *s3.Object) (hidden bool, tags []*s3.Tag, err error) {
+	switch provider.deletePolicy {
+	case DeletePolicyStorageClass:
+		return aws.StringValue(object.StorageClass) == provider.archiveStorageClass, nil, nil
+	case DeletePolicyTag:
+		if provider.deleted != nil {
+			if _, deleted := provider.deleted.get(provider.cacheKey(*object.Key, aws.StringValue(object.ETag))); deleted {
+				return true, nil, nil
+			}
+		}
+		tags, err := provider.getTags(*object.Key)
+		if err != nil {
+			return false, nil, err
+		}
+		if deletedTag(tags) {
+			provider.markDeleted(*object.Key, aws.StringValue(object.ETag))
+			return true, nil, nil
+		}
+		return false, tags, nil
+	}
+	return false, nil, nil
+}
+
+// deletedTag reports whether tags mark the object as deleted.
+func deletedTag(tags []*s3.Tag) bool {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == deletedTagKey && aws.StringValue(tag.Value) == deletedTagValue {
+			return true
+		}
+	}
+	return false
+}
+
+func (provider *s3Provider) markDeleted(key, etag string) {
+	if etag == "" || provider.deleted == nil {
+		return
+	}
+	provider.deleted.add(provider.cacheKey(key, etag), true)
+}
+
+// sortObjects sorts objects by the configured order. Ties and objects without a time are ordered by key
+// so that the order does not depend on the order of the listing. The Date headers are read concurrently
+// by up to maxDateRequests requests.
+func (provider *s3Provider) sortObjects(objects []*s3.Object) (err error) {
+	times := make(map[string]time.Time)
+	switch provider.order {
+	case OrderLastModified:
+		for _, object := range objects {
+			times[*object.Key] = aws.TimeValue(object.LastModified)
+		}
+	case OrderDate:
+		dates := make([]time.Time, len(objects))
+		errs := make([]error, len(objects))
+		var wg sync.WaitGroup
+		semaphore := make(chan struct{}, maxDateRequests)
+		for index, object := range objects {
+			wg.Add(1)
+			semaphore <- struct{}{}
+			go func(index int, object *s3.Object) {
+				defer wg.Done()
+				dates[index], errs[index] = provider.getDate(object)
+				<-semaphore
+			}(index, object)
+		}
+		wg.Wait()
+		for index, object := range objects {
+			if errs[index] != nil {
+				return errs[index]
+			}
+			times[*object.Key] = dates[index]
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		left, right := times[*objects[i].Key], times[*objects[j].Key]
+		if !left.Equal(right) {
+			return left.Before(right)
+		}
+		return *objects[i].Key < *objects[j].Key
+	})
+	return nil
+}
+
+// getDate returns the time of the Date header of object or its LastModified if the header is missing or invalid.
+// Only the headers are read and the result is cached for the lifetime of the process.
+func (provider *s3Provider) getDate(object *s3.Object) (date time.Time, err error) {
+	etag := aws.StringValue(object.ETag)
+	key := provider.cacheKey(*object.Key, etag)
+	if date, exists := dates.get(key); exists {
+		return date, nil
+	}
+	reader, err := provider.newRangeReader(*object.Key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer reader.Close()
+	date = aws.TimeValue(object.LastModified)
+	if message, err := mail.ReadMessage(reader); err == nil {
+		if headerDate, err := message.Header.Date(); err == nil {
+			date = headerDate
+		}
+	} else if errors.Is(err, ErrTemporary) || errors.Is(err, ErrPermanent) {
+		// Other errors are caused by malformed headers.
+		return time.Time{}, err
+	}
+	if etag != "" {
+		dates.add(key, date)
+	}
+	return date, nil
+}
+
+// cacheKey identifies a version of an object across the buckets of all endpoints and regions.
+func (provider *s3Provider) cacheKey(key, etag string) string {
+	return provider.endpoint + "|" + provider.region + "|" + provider.bucket + "/" + key + "@" + etag
+}
+
+// computeWireSizes replaces the raw object sizes of the given emails with their exact wire sizes.
+// Up to maxSizeRequests of them are computed concurrently. If an email fails, the others are still updated.
+func (provider *s3Provider) computeWireSizes(numbers []int) (err error) {
+	var unsized []int
+	for _, number := range numbers {
+		if _, exists := provider.cache.unsized[number]; exists {
+			unsized = append(unsized, number)
+		}
+	}
+	sizes := make([]int64, len(unsized))
+	errs := make([]error, len(unsized))
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, maxSizeRequests)
+	for index, number := range unsized {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(index int, email *Email, tags []*s3.Tag) {
+			defer wg.Done()
+			sizes[index], errs[index] = provider.computeWireSize(email, tags)
+			<-semaphore
+		}(index, provider.cache.emails[number], provider.cache.tags[number])
+	}
+	wg.Wait()
+	for index, number := range unsized {
+		if errs[index] != nil {
+			if err == nil {
+				err = errs[index]
+			}
+			continue
+		}
+		email := provider.cache.emails[number]
+		email.Size = sizes[index]
+		provider.cacheWireSize(provider.prefix+email.ID, provider.cache.unsized[number], sizes[index])
+		delete(provider.cache.unsized, number)
+		delete(provider.cache.tags, number)
+	}
+	return err
+}
+
+// computeWireSize returns the wire size of email. It is read from tags, which are requested if they have not
+// been read while listing and wire size tags are enabled. Otherwise, the object is downloaded to compute it.
+func (provider *s3Provider) computeWireSize(email *Email, tags []*s3.Tag) (size int64, err error) {
+	key := provider.prefix + email.ID
+	if tags == nil && provider.wireSizeTags {
+		if tags, err = provider.getTags(key); err != nil {
+			// The wire size can still be computed, e.g. if the tags may not be read.
+			log.Printf("Error provider.getTags(): %v", err)
+		}
+	}
+	if size, found := wireSizeTag(tags); found {
+		return size, nil
+	}
+	reader, err := provider.getObject(email)
+	if err != nil {
+		return 0, err
+	}
+	size, err = EncodeMessage(io.Discard, reader, -1)
+	reader.Close()
+	if err != nil {
+		return 0, wrapS3Error(err)
+	}
+	// The tags of DeletePolicyTag are not written as the deleted tag of another session could be overwritten.
+	if provider.wireSizeTags && provider.deletePolicy != DeletePolicyTag {
+		if err := provider.putWireSizeTag(key, size); err != nil {
+			log.Printf("Error provider.putWireSizeTag(): %v", err)
+		}
+	}
+	return size, nil
+}
+
+func (provider *s3Provider) cachedWireSize(key, etag string) (size int64, exists bool) {
+	if provider.sizes == nil {
+		return 0, false
+	}
+	return provider.sizes.get(provider.cacheKey(key, etag))
+}
+
+// cacheWireSize caches the wire size of the object unless it has no ETag as it cannot be told apart
+// from a later version then.
+func (provider *s3Provider) cacheWireSize(key, etag string, size int64) {
+	if etag != "" && provider.sizes != nil {
+		provider.sizes.add(provider.cacheKey(key, etag), size)
+	}
+}
+
+// getTags returns the tags of the object. The result is not nil unless an error is returned.
+func (provider *s3Provider) getTags(key string) (tags []*s3.Tag, err error) {
+	res, err := provider.client.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket: aws.String(provider.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, wrapS3Error(err)
+	}
+	return append([]*s3.Tag{}, res.TagSet...), nil
+}
+
+// wireSizeTag returns the wire size stored in tags.
+func wireSizeTag(tags []*s3.Tag) (size int64, found bool) {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) != wireSizeTagKey {
+			continue
+		}
+		size, err := strconv.ParseInt(aws.StringValue(tag.Value), 10, 64)
+		return size, err == nil && size >= 0
+	}
+	return 0, false
+}
+
+// putWireSizeTag adds the wire size to the tags of the object. The tags are read again right before so that
+// the put is skipped if they have changed in the meantime, e.g. the object has been tagged as deleted, or if
+// the object already has the maximum number of tags.
+func (provider *s3Provider) putWireSizeTag(key string, size int64) (err error) {
+	tags, err := provider.getTags(key)
+	if err != nil {
+		return err
+	}
+	if _, found := wireSizeTag(tags); found || deletedTag(tags) || len(tags) >= maxObjectTags {
+		return nil
+	}
+	tags = append(tags, &s3.Tag{
+		Key:   aws.String(wireSizeTagKey),
+		Value: aws.String(strconv.FormatInt(size, 10)),
+	})
+	if _, err := provider.client.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  aws.String(provider.bucket),
+		Key:     aws.String(key),
+		Tagging: &s3.Tagging{TagSet: tags},
+	}); err != nil {
+		return wrapS3Error(err)
 	}
 	return nil
 }
 
 func (provider *s3Provider) ListEmails(notNumbers []int) (emails map[int]*Email, err error) {
+	emails, err = provider.listEmails(notNumbers)
+	if err != nil {
+		return nil, err
+	}
+	if err := provider.computeWireSizes(GetSortedMailNumbers(emails)); err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+// listEmails returns the emails without computing their wire sizes.
+func (provider *s3Provider) listEmails(notNumbers []int) (emails map[int]*Email, err error) {
 	if provider.cache == nil {
 		err := provider.initCache()
 		if err != nil {
@@ -115,52 +726,268 @@ func (provider *s3Provider) ListEmails(notNumbers []int) (emails map[int]*Email,
 }
 
 func (provider *s3Provider) GetEmail(number int, notNumbers []int) (email *Email, err error) {
-	emails, err := provider.ListEmails(notNumbers)
+	email, err = provider.getEmail(number, notNumbers)
+	if err != nil {
+		return nil, err
+	}
+	if err := provider.computeWireSizes([]int{number}); err != nil {
+		return nil, err
+	}
+	return email, nil
+}
+
+// ListUnsizedEmails implements UnsizedProvider.
+func (provider *s3Provider) ListUnsizedEmails(notNumbers []int) (emails map[int]*Email, err error) {
+	return provider.listEmails(notNumbers)
+}
+
+// GetUnsizedEmail implements UnsizedProvider.
+func (provider *s3Provider) GetUnsizedEmail(number int, notNumbers []int) (email *Email, err error) {
+	return provider.getEmail(number, notNumbers)
+}
+
+// getEmail returns the email without computing its wire size.
+func (provider *s3Provider) getEmail(number int, notNumbers []int) (email *Email, err error) {
+	emails, err := provider.listEmails(notNumbers)
 	if err != nil {
 		return nil, err
 	}
 	if email, exists := emails[number]; exists {
 		return email, nil
 	}
-	return nil, fmt.Errorf("%v does not exist", number)
+	return nil, fmt.Errorf("%w: %v does not exist", ErrNoSuchEmail, number)
 }
 
-func (provider *s3Provider) GetEmailPayload(number int, notNumbers []int) (payload EmailPayload, err error) {
-	email, err := provider.GetEmail(number, notNumbers)
+func (provider *s3Provider) GetEmailReader(number int, notNumbers []int) (reader io.ReadCloser, err error) {
+	email, err := provider.getEmail(number, notNumbers)
 	if err != nil {
 		return nil, err
 	}
-	if email.Payload == nil {
-		buf := aws.NewWriteAtBuffer([]byte{})
-		_, err = provider.downloader.Download(buf, &s3.GetObjectInput{
+	return provider.getObject(email)
+}
+
+// GetEmailTopReader reads the object using ranged requests that start at initialRangeSize and double
+// in size until the reader is closed, e.g. once the headers and the requested lines of the body are read.
+func (provider *s3Provider) GetEmailTopReader(number int, notNumbers []int) (reader io.ReadCloser, err error) {
+	email, err := provider.getEmail(number, notNumbers)
+	if err != nil {
+		return nil, err
+	}
+	return provider.newRangeReader(provider.prefix + email.ID)
+}
+
+func (provider *s3Provider) newRangeReader(key string) (reader *rangeReader, err error) {
+	reader = &rangeReader{
+		provider:  provider,
+		key:       key,
+		rangeSize: initialRangeSize,
+	}
+	// The first range is requested immediately so that a missing object is reported before the response starts.
+	if err := reader.fetch(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+type rangeReader struct {
+	provider *s3Provider
+	key      string
+	// etag ensures that all ranges belong to the same version of the object.
+	etag      string
+	body      io.ReadCloser
+	offset    int64
+	rangeSize int64
+	last      bool
+}
+
+func (reader *rangeReader) fetch() (err error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(reader.provider.bucket),
+		Key:    aws.String(reader.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%v-%v", reader.offset, reader.offset+reader.rangeSize-1)),
+	}
+	if reader.etag != "" {
+		input.IfMatch = aws.String(reader.etag)
+	}
+	res, err := reader.provider.client.GetObject(input)
+	if err != nil {
+		var requestFailure awserr.RequestFailure
+		// The range starts after the end of the object, e.g. if it is empty or its size is a multiple of the range.
+		if errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusRequestedRangeNotSatisfiable {
+			reader.body = io.NopCloser(bytes.NewReader(nil))
+			reader.last = true
+			return nil
+		}
+		return wrapS3Error(err)
+	}
+	reader.body = res.Body
+	reader.etag = aws.StringValue(res.ETag)
+	var start, end, size int64
+	if _, err := fmt.Sscanf(aws.StringValue(res.ContentRange), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		// The whole object was returned as the range was not applied.
+		reader.last = true
+		return nil
+	}
+	reader.offset = end + 1
+	reader.rangeSize *= 2
+	reader.last = reader.offset >= size
+	return nil
+}
+
+func (reader *rangeReader) Read(b []byte) (n int, err error) {
+	for {
+		n, err := reader.body.Read(b)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if reader.last {
+			return 0, io.EOF
+		}
+		reader.body.Close()
+		if err := reader.fetch(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (reader *rangeReader) Close() error {
+	return reader.body.Close()
+}
+
+func (provider *s3Provider) getObject(email *Email) (reader io.ReadCloser, err error) {
+	res, err := provider.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(provider.bucket),
+		Key:    aws.String(provider.prefix + email.ID),
+	})
+	if err != nil {
+		return nil, wrapS3Error(err)
+	}
+	return res.Body, nil
+}
+
+// DeleteEmails applies the delete policy to the emails and continues on failures. Objects are removed in batches of
+// at most maxDeleteObjects; if they are archived, only those that have been copied successfully.
+func (provider *s3Provider) DeleteEmails(numbers []int) (err error) {
+	var keys []*s3.ObjectIdentifier
+	var failedIDs []string
+	var errs []error
+	for _, number := range numbers {
+		email, err := provider.getEmail(number, nil)
+		if err != nil {
+			return err
+		}
+		key := provider.prefix + email.ID
+		switch provider.deletePolicy {
+		case DeletePolicyArchive:
+			err = provider.archiveObject(key)
+		case DeletePolicyTag:
+			err = provider.tagObject(key, provider.cache.etags[number])
+		case DeletePolicyStorageClass:
+			err = provider.transitionObject(key)
+		}
+		if err != nil {
+			failedIDs = append(failedIDs, email.ID)
+			errs = append(errs, fmt.Errorf("%v: %w", email.ID, err))
+			continue
+		}
+		if provider.deletePolicy == DeletePolicyTag || provider.deletePolicy == DeletePolicyStorageClass {
+			continue
+		}
+		keys = append(keys, &s3.ObjectIdentifier{
+			Key: aws.String(key),
+		})
+	}
+	for start := 0; start < len(keys); start += maxDeleteObjects {
+		batch := keys[start:min(start+maxDeleteObjects, len(keys))]
+		res, err := provider.client.DeleteObjects(&s3.DeleteObjectsInput{
 			Bucket: aws.String(provider.bucket),
-			Key:    aws.String(provider.prefix + email.ID),
+			Delete: &s3.Delete{
+				Objects: batch,
+				Quiet:   aws.Bool(true),
+			},
 		})
 		if err != nil {
-			return nil, err
+			for _, key := range batch {
+				failedIDs = append(failedIDs, strings.TrimPrefix(*key.Key, provider.prefix))
+			}
+			errs = append(errs, wrapS3Error(err))
+			continue
+		}
+		for _, deleteErr := range res.Errors {
+			id := strings.TrimPrefix(aws.StringValue(deleteErr.Key), provider.prefix)
+			failedIDs = append(failedIDs, id)
+			errs = append(errs, fmt.Errorf("%v: %v: %v", id, aws.StringValue(deleteErr.Code), aws.StringValue(deleteErr.Message)))
 		}
-		var payload EmailPayload
-		payload = buf.Bytes()
-		email.Payload = &payload
 	}
-	return *email.Payload, nil
+	if len(failedIDs) > 0 {
+		return &DeleteError{
+			IDs: failedIDs,
+			Err: errors.Join(errs...),
+		}
+	}
+	return nil
+}
+
+// copySource returns the URL encoded source of a CopyObject request.
+func (provider *s3Provider) copySource(key string) string {
+	return url.PathEscape(provider.bucket + "/" + key)
 }
 
-func (provider *s3Provider) DeleteEmail(number int) (err error) {
-	email, err := provider.GetEmail(number, nil)
+func (provider *s3Provider) archiveObject(key string) (err error) {
+	_, err = provider.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(provider.archiveBucket),
+		Key:        aws.String(provider.archivePrefix + strings.TrimPrefix(key, provider.prefix)),
+		CopySource: aws.String(provider.copySource(key)),
+	})
 	if err != nil {
-		return err
+		return wrapS3Error(err)
 	}
-	_, err = provider.client.DeleteObject(&s3.DeleteObjectInput{
+	return nil
+}
+
+// tagObject adds the deleted tag to the existing tags of the object.
+func (provider *s3Provider) tagObject(key, etag string) (err error) {
+	res, err := provider.client.GetObjectTagging(&s3.GetObjectTaggingInput{
 		Bucket: aws.String(provider.bucket),
-		Key:    aws.String(provider.prefix + email.ID),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		return err
+		return wrapS3Error(err)
 	}
-	err = provider.client.WaitUntilObjectNotExists(&s3.HeadObjectInput{
-		Bucket: aws.String(provider.bucket),
-		Key:    aws.String(provider.prefix + email.ID),
+	tags := []*s3.Tag{{
+		Key:   aws.String(deletedTagKey),
+		Value: aws.String(deletedTagValue),
+	}}
+	for _, tag := range res.TagSet {
+		if aws.StringValue(tag.Key) != deletedTagKey {
+			tags = append(tags, tag)
+		}
+	}
+	if _, err := provider.client.PutObjectTagging(&s3.PutObjectTaggingInput{
+		Bucket:  aws.String(provider.bucket),
+		Key:     aws.String(key),
+		Tagging: &s3.Tagging{TagSet: tags},
+	}); err != nil {
+		return wrapS3Error(err)
+	}
+	provider.markDeleted(key, etag)
+	return nil
+}
+
+// transitionObject copies the object onto itself to change its storage class.
+func (provider *s3Provider) transitionObject(key string) (err error) {
+	_, err = provider.client.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(provider.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(provider.copySource(key)),
+		StorageClass:      aws.String(provider.archiveStorageClass),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
 	})
-	return err
+	if err != nil {
+		return wrapS3Error(err)
+	}
+	return nil
 }
@@ -17,64 +17,199 @@
 package provider
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 	"github.com/stretchr/testify/assert"
 )
 
 type mockItem struct {
-	key   string
-	size  int64
-	bytes []byte
+	key          string
+	size         int64
+	bytes        []byte
+	etag         string
+	lastModified time.Time
+	tags         map[string]string
+	storageClass string
 }
 
 type mockClient struct {
 	s3iface.S3API
-	items     []mockItem
-	listErr   error
-	deleteErr error
+	items         []mockItem
+	listErr       error
+	deleteErr     error
+	deleteFailing map[string]bool
+	deleteBatches []int
+	getErr        error
+	// getRanges records the Range of every GetObject request.
+	getRanges []string
+	// pageSize limits the objects per ListObjectsV2 response, defaults to 1000.
+	pageSize  int
+	listPages int
+	// copies records the CopyObject requests; those with a source in copyFailing fail.
+	copies      []*s3.CopyObjectInput
+	copyFailing map[string]bool
+	// putTags records the tags of every PutObjectTagging request by key.
+	putTags map[string][]*s3.Tag
+	// tagMutex guards the items and tagRequests as the tags are requested and the objects downloaded concurrently.
+	tagMutex    sync.Mutex
+	tagRequests int
 }
 
 var _ s3iface.S3API = &mockClient{}
 
 func (mock *mockClient) ListObjectsV2(input *s3.ListObjectsV2Input) (output *s3.ListObjectsV2Output, err error) {
+	mock.listPages++
+	pageSize := mock.pageSize
+	if pageSize == 0 {
+		pageSize = 1000
+	}
+	start := 0
+	if input.ContinuationToken != nil {
+		if start, err = strconv.Atoi(*input.ContinuationToken); err != nil {
+			return nil, err
+		}
+	}
+	end := start + pageSize
+	if end > len(mock.items) {
+		end = len(mock.items)
+	}
 	var contents []*s3.Object
-	for _, item := range mock.items {
+	for _, item := range mock.items[start:end] {
 		key := item.key
 		size := item.size
-		contents = append(contents, &s3.Object{
+		object := &s3.Object{
 			Key:  &key,
 			Size: &size,
-		})
+		}
+		if item.etag != "" {
+			object.ETag = aws.String(item.etag)
+		}
+		if !item.lastModified.IsZero() {
+			object.LastModified = aws.Time(item.lastModified)
+		}
+		if item.storageClass != "" {
+			object.StorageClass = aws.String(item.storageClass)
+		}
+		contents = append(contents, object)
+	}
+	output = &s3.ListObjectsV2Output{Contents: contents, IsTruncated: aws.Bool(end < len(mock.items))}
+	if end < len(mock.items) {
+		output.NextContinuationToken = aws.String(strconv.Itoa(end))
 	}
-	return &s3.ListObjectsV2Output{Contents: contents}, mock.listErr
+	return output, mock.listErr
 }
 
-func (mock *mockClient) DeleteObject(*s3.DeleteObjectInput) (input *s3.DeleteObjectOutput, err error) {
-	return &s3.DeleteObjectOutput{}, mock.deleteErr
+func (mock *mockClient) DeleteObjects(input *s3.DeleteObjectsInput) (output *s3.DeleteObjectsOutput, err error) {
+	mock.deleteBatches = append(mock.deleteBatches, len(input.Delete.Objects))
+	if mock.deleteErr != nil {
+		return nil, mock.deleteErr
+	}
+	output = &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		if mock.deleteFailing[*object.Key] {
+			output.Errors = append(output.Errors, &s3.Error{
+				Key:     object.Key,
+				Code:    aws.String("AccessDenied"),
+				Message: aws.String("Access Denied"),
+			})
+		}
+	}
+	return output, nil
 }
 
-func (mock *mockClient) WaitUntilObjectNotExists(input *s3.HeadObjectInput) error {
-	return mock.deleteErr
+func (mock *mockClient) CopyObject(input *s3.CopyObjectInput) (output *s3.CopyObjectOutput, err error) {
+	mock.copies = append(mock.copies, input)
+	if mock.copyFailing[*input.CopySource] {
+		return nil, awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "")
+	}
+	return &s3.CopyObjectOutput{}, nil
 }
 
-type mockDownloader struct {
-	s3manageriface.DownloaderAPI
-	mockItem mockItem
-	err      error
+func (mock *mockClient) GetObjectTagging(input *s3.GetObjectTaggingInput) (output *s3.GetObjectTaggingOutput, err error) {
+	mock.tagMutex.Lock()
+	defer mock.tagMutex.Unlock()
+	mock.tagRequests++
+	output = &s3.GetObjectTaggingOutput{}
+	for _, item := range mock.items {
+		if item.key == *input.Key {
+			for key, value := range item.tags {
+				output.TagSet = append(output.TagSet, &s3.Tag{Key: aws.String(key), Value: aws.String(value)})
+			}
+		}
+	}
+	return output, nil
 }
 
-var _ s3manageriface.DownloaderAPI = &mockDownloader{}
+func (mock *mockClient) PutObjectTagging(input *s3.PutObjectTaggingInput) (output *s3.PutObjectTaggingOutput, err error) {
+	mock.tagMutex.Lock()
+	defer mock.tagMutex.Unlock()
+	if mock.putTags == nil {
+		mock.putTags = make(map[string][]*s3.Tag)
+	}
+	mock.putTags[*input.Key] = input.Tagging.TagSet
+	for index, item := range mock.items {
+		if item.key == *input.Key {
+			mock.items[index].tags = make(map[string]string)
+			for _, tag := range input.Tagging.TagSet {
+				mock.items[index].tags[*tag.Key] = *tag.Value
+			}
+		}
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
 
-func (mock *mockDownloader) Download(writer io.WriterAt, input *s3.GetObjectInput, options ...func(*s3manager.Downloader)) (size int64, err error) {
-	writer.WriteAt(mock.mockItem.bytes, 0)
-	return int64(len(mock.mockItem.bytes)), mock.err
+func (mock *mockClient) GetObject(input *s3.GetObjectInput) (output *s3.GetObjectOutput, err error) {
+	mock.tagMutex.Lock()
+	defer mock.tagMutex.Unlock()
+	if mock.getErr != nil {
+		return nil, mock.getErr
+	}
+	for _, item := range mock.items {
+		if item.key == *input.Key {
+			content := item.bytes
+			if content == nil && item.size >= 2 {
+				// Items without bytes consist of a CRLF terminated line so that their wire size equals their size.
+				content = append(bytes.Repeat([]byte("a"), int(item.size-2)), "\r\n"...)
+			}
+			if input.IfMatch != nil && *input.IfMatch != item.etag {
+				return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), 412, "")
+			}
+			output = &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(content))}
+			if item.etag != "" {
+				output.ETag = aws.String(item.etag)
+			}
+			if input.Range != nil {
+				mock.getRanges = append(mock.getRanges, *input.Range)
+				var start, end int64
+				if _, err := fmt.Sscanf(*input.Range, "bytes=%d-%d", &start, &end); err != nil {
+					return nil, err
+				}
+				size := int64(len(content))
+				if start >= size {
+					return nil, awserr.NewRequestFailure(awserr.New("InvalidRange", "The requested range is not satisfiable", nil), 416, "")
+				}
+				if end >= size {
+					end = size - 1
+				}
+				output.Body = io.NopCloser(bytes.NewReader(content[start : end+1]))
+				output.ContentRange = aws.String(fmt.Sprintf("bytes %v-%v/%v", start, end, size))
+			}
+			return output, nil
+		}
+	}
+	return nil, awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil), 404, "")
 }
 
 func TestInitCache(t *testing.T) {
@@ -196,6 +331,159 @@ func TestInitCache(t *testing.T) {
 	}
 }
 
+func TestInitCachePagination(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		items     int
+		pageSize  int
+		maxEmails int
+		wantPages int
+		wantErr   error
+	}{
+		{
+			name:      "single page",
+			items:     1000,
+			wantPages: 1,
+		},
+		{
+			name:      "multiple pages",
+			items:     2500,
+			wantPages: 3,
+		},
+		{
+			name:      "small pages",
+			items:     10,
+			pageSize:  3,
+			wantPages: 4,
+		},
+		{
+			name:      "at the limit",
+			items:     2000,
+			maxEmails: 2000,
+			wantPages: 2,
+		},
+		{
+			name:      "above the limit",
+			items:     2500,
+			maxEmails: 1500,
+			wantPages: 2,
+			wantErr:   ErrMaildropTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			client := &mockClient{pageSize: tt.pageSize}
+			for index := 0; index < tt.items; index++ {
+				client.items = append(client.items, mockItem{key: fmt.Sprintf("prefix/%05d", index), size: 10})
+			}
+			provider := s3Provider{
+				bucket:    "bucket",
+				prefix:    "prefix/",
+				client:    client,
+				maxEmails: tt.maxEmails,
+			}
+			err := provider.initCache()
+			assert.EqualValues(t, tt.wantPages, client.listPages)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Nil(t, provider.cache)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, provider.cache.emails, tt.items)
+			for number := 1; number <= tt.items; number++ {
+				assert.EqualValues(t, fmt.Sprintf("%05d", number-1), provider.cache.emails[number].ID)
+			}
+		})
+	}
+}
+
+func TestInitCacheOrder(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	items := []mockItem{
+		{key: "a", etag: "order-a", lastModified: now.Add(2 * time.Minute), bytes: []byte("Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n\r\nbody\r\n")},
+		{key: "b", etag: "order-b", lastModified: now.Add(time.Minute), bytes: []byte("Subject: no date\r\n\r\nbody\r\n")},
+		{key: "c", etag: "order-c", lastModified: now.Add(time.Minute), bytes: []byte("Date: Sun, 01 Jan 2006 15:04:05 +0000\r\n\r\nbody\r\n")},
+		{key: "d", etag: "order-d", lastModified: now, bytes: []byte("Date: invalid\r\n\r\nbody\r\n")},
+		{key: "e", etag: "order-e", lastModified: now.Add(3 * time.Minute), bytes: []byte("malformed header\r\n\r\nbody\r\n")},
+	}
+	tests := []struct {
+		name    string
+		order   string
+		getErr  error
+		want    []string
+		wantErr error
+	}{
+		{
+			name:  "key",
+			order: OrderKey,
+			want:  []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name:  "last modified",
+			order: OrderLastModified,
+			want:  []string{"d", "b", "c", "a", "e"},
+		},
+		{
+			name:  "date",
+			order: OrderDate,
+			want:  []string{"c", "a", "d", "b", "e"},
+		},
+		{
+			name:    "date error",
+			order:   OrderDate,
+			getErr:  awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, ""),
+			wantErr: ErrPermanent,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			client := &mockClient{getErr: tt.getErr}
+			for _, item := range items {
+				// The dates are cached per ETag for the lifetime of the process.
+				item.etag += "-" + tt.name
+				client.items = append(client.items, item)
+			}
+			provider := s3Provider{client: client, order: tt.order}
+			emails, err := provider.ListEmails(nil)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			var got []string
+			for _, number := range GetSortedMailNumbers(emails) {
+				got = append(got, emails[number].ID)
+			}
+			assert.EqualValues(t, tt.want, got)
+
+			// The numbers must not change within a session.
+			client.items[0].lastModified = now.Add(-time.Hour)
+			emails, err = provider.ListEmails(nil)
+			assert.NoError(t, err)
+			for index, number := range GetSortedMailNumbers(emails) {
+				assert.EqualValues(t, tt.want[index], emails[number].ID)
+			}
+		})
+	}
+}
+
+func TestNewS3ProviderOrder(t *testing.T) {
+	t.Parallel()
+	provider, err := newS3Provider("user", S3Bucket{Region: "eu-central-1", Bucket: "bucket"}, Policy{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, OrderKey, provider.order)
+
+	_, err = newS3Provider("user", S3Bucket{Region: "eu-central-1", Bucket: "bucket", Order: "random"}, Policy{})
+	assert.ErrorIs(t, err, ErrPermanent)
+}
+
 func TestListEmails(t *testing.T) {
 	t.Parallel()
 	type args struct {
@@ -483,7 +771,7 @@ func TestGetEmail(t *testing.T) {
 	}
 }
 
-func TestGetEmaiPayload(t *testing.T) {
+func TestGetEmailReader(t *testing.T) {
 	t.Parallel()
 	type args struct {
 		provider   s3Provider
@@ -493,7 +781,7 @@ func TestGetEmaiPayload(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		want    EmailPayload
+		want    []byte
 		wantErr bool
 	}{
 		{
@@ -503,16 +791,12 @@ func TestGetEmaiPayload(t *testing.T) {
 					client: &mockClient{
 						items: []mockItem{
 							{
-								key:  "abc123",
-								size: 1000,
+								key:   "abc123",
+								size:  12,
+								bytes: []byte("Hello World!"),
 							},
 						},
 					},
-					downloader: &mockDownloader{
-						mockItem: mockItem{
-							bytes: []byte("Hello World!"),
-						},
-					},
 				},
 				number: 7,
 			},
@@ -525,152 +809,97 @@ func TestGetEmaiPayload(t *testing.T) {
 					client: &mockClient{
 						items: []mockItem{
 							{
-								key:  "abc123",
-								size: 1000,
-							},
-						},
-					},
-					downloader: &mockDownloader{
-						mockItem: mockItem{
-							bytes: []byte("Hello World!"),
-						},
-					},
-				},
-				number:     2,
-				notNumbers: []int{-8, 2},
-			},
-			wantErr: true,
-		},
-		{
-			name: "download",
-			args: args{
-				provider: s3Provider{
-					client: &mockClient{
-						items: []mockItem{
-							{
-								key:  "abc123",
-								size: 1000,
+								key:   "abc123",
+								size:  12,
+								bytes: []byte("Hello World!"),
 							},
 						},
 					},
-					downloader: &mockDownloader{
-						mockItem: mockItem{
-							bytes: []byte("Hello World!"),
-						},
-					},
 				},
 				number:     1,
-				notNumbers: []int{-8, 2},
+				notNumbers: []int{-8, 1},
 			},
-			want: []byte("Hello World!"),
+			wantErr: true,
 		},
 		{
-			name: "cache payload not loaded",
+			name: "get",
 			args: args{
 				provider: s3Provider{
+					prefix: "prefix/",
 					client: &mockClient{
 						items: []mockItem{
 							{
-								key:  "abc123",
-								size: 1000,
+								key:   "prefix/abc123",
+								size:  12,
+								bytes: []byte("Hello World!"),
 							},
 							{
-								key:  "def456",
-								size: 2000,
-							},
-						},
-					},
-					downloader: &mockDownloader{
-						mockItem: mockItem{
-							bytes: []byte("Hello World!"),
-						},
-					},
-					cache: &s3Cache{
-						emails: map[int]*Email{
-							1: {
-								ID:   "abc123",
-								Size: 1000,
-							},
-							2: {
-								ID:   "def456",
-								Size: 2000,
+								key:   "prefix/def456",
+								size:  14,
+								bytes: []byte("Goodbye World!"),
 							},
 						},
 					},
 				},
 				number:     2,
-				notNumbers: []int{-8, 9},
+				notNumbers: []int{-8, 1},
 			},
-			want: []byte("Hello World!"),
+			want: []byte("Goodbye World!"),
 		},
 		{
-			name: "cache payload loaded",
+			name: "get error",
 			args: args{
 				provider: s3Provider{
 					client: &mockClient{
 						items: []mockItem{
 							{
-								key:  "abc123",
-								size: 1000,
-							},
-							{
-								key:  "def456",
-								size: 2000,
-							},
-						},
-					},
-					downloader: &mockDownloader{
-						mockItem: mockItem{
-							bytes: []byte("This message should not be loaded as the message is already cached"),
-						},
-					},
-					cache: &s3Cache{
-						emails: map[int]*Email{
-							1: {
-								ID:   "abc123",
-								Size: 1000,
-							},
-							2: {
-								ID:   "def456",
-								Size: 2000,
-								Payload: func() *EmailPayload {
-									var greeting EmailPayload
-									greeting = []byte("This is the message that should be loaded")
-									return &greeting
-								}(),
+								key:   "abc123",
+								size:  12,
+								bytes: []byte("Hello World!"),
 							},
 						},
+						getErr: fmt.Errorf("this should fail"),
 					},
 				},
-				number:     2,
-				notNumbers: []int{-8, 9},
+				number: 1,
 			},
-			want: []byte("This is the message that should be loaded"),
+			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			got, err := tt.args.provider.GetEmailPayload(tt.args.number, tt.args.notNumbers)
+			reader, err := tt.args.provider.GetEmailReader(tt.args.number, tt.args.notNumbers)
 			assert.EqualValues(t, tt.wantErr, err != nil)
 			if !tt.wantErr {
+				got, err := io.ReadAll(reader)
+				assert.NoError(t, err)
+				assert.NoError(t, reader.Close())
 				assert.EqualValues(t, tt.want, got)
 			}
 		})
 	}
 }
 
-func TestDeleteEmail(t *testing.T) {
+func TestDeleteEmails(t *testing.T) {
 	t.Parallel()
+	manyItems := make([]mockItem, 2500)
+	manyNumbers := make([]int, 2500)
+	for index := range manyItems {
+		manyItems[index] = mockItem{key: fmt.Sprintf("key%v", index)}
+		manyNumbers[index] = index + 1
+	}
 	type args struct {
 		provider s3Provider
-		number   int
+		numbers  []int
 	}
 	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
+		name        string
+		args        args
+		wantBatches []int
+		wantIDs     []string
+		wantErr     bool
 	}{
 		{
 			name: "emails out of range",
@@ -685,7 +914,7 @@ func TestDeleteEmail(t *testing.T) {
 						},
 					},
 				},
-				number: 7,
+				numbers: []int{7},
 			},
 			wantErr: true,
 		},
@@ -699,39 +928,68 @@ func TestDeleteEmail(t *testing.T) {
 								key:  "abc123",
 								size: 1000,
 							},
+							{
+								key:  "def456",
+								size: 2000,
+							},
 						},
 					},
 				},
-				number: 1,
+				numbers: []int{2, 1},
 			},
+			wantBatches: []int{2},
 		},
 		{
-			name: "delete cache",
+			name: "delete nothing",
+			args: args{
+				provider: s3Provider{
+					client: &mockClient{},
+				},
+			},
+		},
+		{
+			name: "delete batches",
 			args: args{
 				provider: s3Provider{
+					client: &mockClient{
+						items: manyItems,
+					},
+				},
+				numbers: manyNumbers,
+			},
+			wantBatches: []int{1000, 1000, 500},
+		},
+		{
+			name: "delete partial error",
+			args: args{
+				provider: s3Provider{
+					prefix: "prefix/",
 					client: &mockClient{
 						items: []mockItem{
 							{
-								key:  "abc123",
+								key:  "prefix/abc123",
 								size: 1000,
 							},
-						},
-					},
-					cache: &s3Cache{
-						emails: map[int]*Email{
-							1: {
-								ID:   "abc123",
-								Size: 1000,
+							{
+								key:  "prefix/def456",
+								size: 2000,
 							},
-							2: {
-								ID:   "def456",
-								Size: 2000,
+							{
+								key:  "prefix/ghi789",
+								size: 3000,
 							},
 						},
+						deleteFailing: map[string]bool{
+							"prefix/abc123": true,
+							"prefix/ghi789": true,
+						},
 					},
 				},
-				number: 2,
+				numbers: []int{1, 2, 3},
 			},
+			wantBatches: []int{3},
+			wantIDs:     []string{"abc123", "ghi789"},
+			wantErr:     true,
 		},
 		{
 			name: "delete error",
@@ -747,17 +1005,515 @@ func TestDeleteEmail(t *testing.T) {
 						deleteErr: fmt.Errorf("this should fail"),
 					},
 				},
-				number: 1,
+				numbers: []int{1},
 			},
-			wantErr: true,
+			wantBatches: []int{1},
+			wantIDs:     []string{"abc123"},
+			wantErr:     true,
 		},
 	}
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			err := tt.args.provider.DeleteEmail(tt.args.number)
+			err := tt.args.provider.DeleteEmails(tt.args.numbers)
 			assert.EqualValues(t, tt.wantErr, err != nil)
+			assert.EqualValues(t, tt.wantBatches, tt.args.provider.client.(*mockClient).deleteBatches)
+			var deleteErr *DeleteError
+			if errors.As(err, &deleteErr) {
+				assert.ErrorIs(t, err, ErrTemporary)
+				assert.EqualValues(t, tt.wantIDs, deleteErr.IDs)
+			} else {
+				assert.Empty(t, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestS3WireSize(t *testing.T) {
+	t.Parallel()
+	payloads := []string{
+		"Subject: LF\n\nHello\nWorld\n",
+		"Subject: CRLF\r\n\r\nHello\r\nWorld\r\n",
+		"Subject: dots\n\n.\n..\n.Hello\n",
+		"Subject: no trailing newline\n\nHello",
+		"",
+	}
+	var items []mockItem
+	for index, payload := range payloads {
+		items = append(items, mockItem{
+			key:   fmt.Sprintf("wire-size-%v", index),
+			size:  int64(len(payload)),
+			bytes: []byte(payload),
+			etag:  fmt.Sprintf("\"etag%v\"", index),
+		})
+	}
+	sizes := newObjectCache[int64](0)
+	provider := s3Provider{
+		bucket: "TestS3WireSize",
+		client: &mockClient{items: items},
+		sizes:  sizes,
+	}
+	emails, err := provider.ListEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(payloads), len(emails))
+	for number, email := range emails {
+		reader, err := provider.GetEmailReader(number, nil)
+		assert.NoError(t, err)
+		var buf bytes.Buffer
+		_, err = EncodeMessage(&buf, reader, -1)
+		assert.NoError(t, err)
+		assert.EqualValues(t, buf.Len(), email.Size, payloads[number-1])
+	}
+
+	// A later session reuses the sizes without downloading the objects again.
+	cached := s3Provider{
+		bucket: "TestS3WireSize",
+		client: &mockClient{items: items, getErr: fmt.Errorf("this should not be called")},
+		sizes:  sizes,
+	}
+	cachedEmails, err := cached.ListEmails(nil)
+	assert.NoError(t, err)
+	for number, email := range cachedEmails {
+		assert.EqualValues(t, emails[number].Size, email.Size)
+	}
+}
+
+func TestS3WireSizeTag(t *testing.T) {
+	t.Parallel()
+	manyTags := make(map[string]string)
+	for index := 0; index < maxObjectTags; index++ {
+		manyTags[fmt.Sprint(index)] = "a"
+	}
+	client := &mockClient{items: []mockItem{
+		{key: "a", size: 10, etag: "wire-size-tag-a", lastModified: time.Unix(1, 0), tags: map[string]string{wireSizeTagKey: "42"}},
+		{key: "b", size: 10, etag: "wire-size-tag-b", lastModified: time.Unix(2, 0), tags: map[string]string{"source": "ses"}},
+		{key: "c", size: 10, etag: "wire-size-tag-c", lastModified: time.Unix(3, 0), tags: manyTags},
+	}}
+	provider := s3Provider{
+		bucket:       "TestS3WireSizeTag",
+		client:       client,
+		wireSizeTags: true,
+	}
+
+	// UIDL and DELE neither read the tags nor download the objects.
+	emails, err := provider.ListUnsizedEmails(nil)
+	assert.NoError(t, err)
+	assert.Len(t, emails, 3)
+	_, err = provider.GetUnsizedEmail(1, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, client.tagRequests)
+
+	client.getErr = fmt.Errorf("this should not be called")
+	email, err := provider.GetEmail(1, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 42, email.Size)
+	client.getErr = nil
+
+	emails, err = provider.ListEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, map[int]*Email{
+		1: {ID: "a", Size: 42},
+		2: {ID: "b", Size: 10},
+		3: {ID: "c", Size: 10},
+	}, emails)
+	// The computed wire size is added to the existing tags unless the object has the maximum number of tags.
+	assert.EqualValues(t, map[string][]*s3.Tag{
+		"b": {
+			{Key: aws.String("source"), Value: aws.String("ses")},
+			{Key: aws.String(wireSizeTagKey), Value: aws.String("10")},
+		},
+	}, client.putTags)
+
+	// Without wire size tags, the objects are downloaded and the tags are neither read nor written.
+	client = &mockClient{items: []mockItem{
+		{key: "a", size: 10, etag: "wire-size-tag-a", tags: map[string]string{wireSizeTagKey: "42"}},
+	}}
+	provider = s3Provider{
+		bucket: "TestS3WireSizeTag",
+		client: client,
+	}
+	emails, err = provider.ListEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, map[int]*Email{1: {ID: "a", Size: 10}}, emails)
+	assert.EqualValues(t, 0, client.tagRequests)
+	assert.Empty(t, client.putTags)
+
+	// The tags read while listing are reused and never written by the tag delete policy.
+	client = &mockClient{items: []mockItem{
+		{key: "a", size: 10, etag: "wire-size-tag-a", lastModified: time.Unix(1, 0), tags: map[string]string{wireSizeTagKey: "42"}},
+		{key: "b", size: 10, etag: "wire-size-tag-b", lastModified: time.Unix(2, 0)},
+	}}
+	provider = s3Provider{
+		bucket:       "TestS3WireSizeTag",
+		client:       client,
+		deletePolicy: DeletePolicyTag,
+		wireSizeTags: true,
+	}
+	emails, err = provider.ListEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, map[int]*Email{1: {ID: "a", Size: 42}, 2: {ID: "b", Size: 10}}, emails)
+	assert.EqualValues(t, 2, client.tagRequests)
+	assert.Empty(t, client.putTags)
+}
+
+func TestPutWireSizeTag(t *testing.T) {
+	t.Parallel()
+	client := &mockClient{items: []mockItem{
+		{key: "deleted", tags: map[string]string{deletedTagKey: deletedTagValue}},
+		{key: "sized", tags: map[string]string{wireSizeTagKey: "42"}},
+		{key: "a", tags: map[string]string{"source": "ses"}},
+	}}
+	provider := s3Provider{
+		bucket: "TestPutWireSizeTag",
+		client: client,
+	}
+	// The tags are read again so that tags set in the meantime are neither overwritten nor duplicated.
+	for _, key := range []string{"deleted", "sized", "a"} {
+		assert.NoError(t, provider.putWireSizeTag(key, 10))
+	}
+	assert.EqualValues(t, map[string][]*s3.Tag{
+		"a": {
+			{Key: aws.String("source"), Value: aws.String("ses")},
+			{Key: aws.String(wireSizeTagKey), Value: aws.String("10")},
+		},
+	}, client.putTags)
+}
+
+func TestS3WireSizeConcurrent(t *testing.T) {
+	t.Parallel()
+	var items []mockItem
+	want := make(map[int]*Email)
+	for index := 0; index < 100; index++ {
+		key := fmt.Sprintf("concurrent/%03d", index)
+		items = append(items, mockItem{key: key, size: int64(index + 2), etag: key})
+		want[index+1] = &Email{ID: key, Size: int64(index + 2)}
+	}
+	client := &mockClient{items: items}
+	provider := s3Provider{
+		bucket: "TestS3WireSizeConcurrent",
+		order:  OrderKey,
+		client: client,
+	}
+	_, err := provider.listEmails(nil)
+	assert.NoError(t, err)
+
+	// The sizes of the other emails are computed even though the first one has been removed in the meantime.
+	client.items = items[1:]
+	_, err = provider.ListEmails(nil)
+	assert.ErrorIs(t, err, ErrPermanent)
+	assert.Len(t, provider.cache.unsized, 1)
+	assert.Contains(t, provider.cache.unsized, 1)
+
+	client.items = items
+	emails, err := provider.ListEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, want, emails)
+}
+
+func TestGetEmailTopReader(t *testing.T) {
+	t.Parallel()
+	headers := "Subject: " + strings.Repeat("a", 20*1024) + "\r\n\r\n"
+	body := strings.Repeat("line\r\n", 20*1024)
+	tests := []struct {
+		name       string
+		bytes      string
+		bodyLines  int
+		wantRanges []string
+		getErr     error
+		wantErr    error
+	}{
+		{
+			name:       "first range",
+			bytes:      "Subject: a\r\n\r\n" + body,
+			bodyLines:  1,
+			wantRanges: []string{"bytes=0-16383"},
+		},
+		{
+			name:       "growing range",
+			bytes:      headers + body,
+			bodyLines:  10,
+			wantRanges: []string{"bytes=0-16383", "bytes=16384-49151"},
+		},
+		{
+			name:       "whole object",
+			bytes:      headers + body,
+			bodyLines:  20 * 1024,
+			wantRanges: []string{"bytes=0-16383", "bytes=16384-49151", "bytes=49152-114687", "bytes=114688-245759"},
+		},
+		{
+			name:       "size multiple of the range",
+			bytes:      strings.Repeat("a", 16*1024-2) + "\r\n",
+			bodyLines:  10,
+			wantRanges: []string{"bytes=0-16383"},
+		},
+		{
+			name:       "empty",
+			bodyLines:  10,
+			wantRanges: []string{"bytes=0-16383"},
+		},
+		{
+			name:    "error",
+			getErr:  awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, ""),
+			wantErr: ErrPermanent,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			client := &mockClient{
+				items:  []mockItem{{key: "prefix/a", size: int64(len(tt.bytes)), bytes: []byte(tt.bytes), etag: "etag"}},
+				getErr: tt.getErr,
+			}
+			provider := &s3Provider{
+				bucket: "bucket",
+				prefix: "prefix/",
+				client: client,
+				cache:  &s3Cache{emails: map[int]*Email{1: {ID: "a"}}},
+			}
+			reader, err := provider.GetEmailTopReader(1, nil)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			var got, want bytes.Buffer
+			_, err = EncodeMessage(&got, reader, tt.bodyLines)
+			assert.NoError(t, err)
+			assert.NoError(t, reader.Close())
+			_, err = EncodeMessage(&want, strings.NewReader(tt.bytes), tt.bodyLines)
+			assert.NoError(t, err)
+			assert.EqualValues(t, want.String(), got.String())
+			assert.EqualValues(t, tt.wantRanges, client.getRanges)
+		})
+	}
+}
+
+func TestRoleSessionName(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		user string
+		want string
+	}{
+		{user: "jane.doe+pop3@example.com", want: "jane.doe+pop3@example.com"},
+		{user: "jane doe/ü", want: "jane-doe--"},
+		{user: "j", want: "j-"},
+		{user: "", want: "--"},
+		{user: strings.Repeat("a", 70), want: strings.Repeat("a", 64)},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.user, func(t *testing.T) {
+			t.Parallel()
+			assert.EqualValues(t, tt.want, roleSessionName(tt.user))
+		})
+	}
+}
+
+func TestNewS3ProviderDeletePolicy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		bucket  S3Bucket
+		wantErr bool
+	}{
+		{name: "default", bucket: S3Bucket{}},
+		{name: "tag", bucket: S3Bucket{DeletePolicy: DeletePolicyTag}},
+		{name: "archive prefix", bucket: S3Bucket{Prefix: "inbox", DeletePolicy: DeletePolicyArchive, ArchivePrefix: "archive"}},
+		{name: "archive prefix below prefix", bucket: S3Bucket{Prefix: "inbox", DeletePolicy: DeletePolicyArchive, ArchivePrefix: "inbox/archive"}, wantErr: true},
+		{name: "archive same bucket", bucket: S3Bucket{DeletePolicy: DeletePolicyArchive}, wantErr: true},
+		{name: "archive bucket", bucket: S3Bucket{DeletePolicy: DeletePolicyArchive, ArchiveBucket: "archive"}},
+		{name: "storage class", bucket: S3Bucket{DeletePolicy: DeletePolicyStorageClass, ArchiveStorageClass: s3.StorageClassGlacier}},
+		{name: "storage class missing", bucket: S3Bucket{DeletePolicy: DeletePolicyStorageClass}, wantErr: true},
+		{name: "storage class standard", bucket: S3Bucket{DeletePolicy: DeletePolicyStorageClass, ArchiveStorageClass: s3.StorageClassStandard}, wantErr: true},
+		{name: "unknown", bucket: S3Bucket{DeletePolicy: "shred"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tt.bucket.Region = "eu-central-1"
+			tt.bucket.Bucket = "bucket"
+			_, err := newS3Provider("user", tt.bucket, Policy{})
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrPermanent)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDeleteEmailsPolicy(t *testing.T) {
+	t.Parallel()
+	items := func() []mockItem {
+		return []mockItem{
+			{key: "inbox/a", size: 10, etag: "delete-policy-a", tags: map[string]string{"source": "ses"}},
+			{key: "inbox/b", size: 10, etag: "delete-policy-b"},
+		}
+	}
+	tests := []struct {
+		name       string
+		provider   s3Provider
+		wantCopies []*s3.CopyObjectInput
+		wantTags   map[string][]*s3.Tag
+		wantDelete []int
+		wantIDs    []string
+	}{
+		{
+			name: "archive",
+			provider: s3Provider{
+				bucket:        "bucket",
+				prefix:        "inbox/",
+				deletePolicy:  DeletePolicyArchive,
+				archiveBucket: "archive",
+				archivePrefix: "jane/",
+				client: &mockClient{
+					items:       items(),
+					copyFailing: map[string]bool{"bucket%2Finbox%2Fb": true},
+				},
+			},
+			wantCopies: []*s3.CopyObjectInput{
+				{Bucket: aws.String("archive"), Key: aws.String("jane/a"), CopySource: aws.String("bucket%2Finbox%2Fa")},
+				{Bucket: aws.String("archive"), Key: aws.String("jane/b"), CopySource: aws.String("bucket%2Finbox%2Fb")},
+			},
+			wantDelete: []int{1},
+			wantIDs:    []string{"b"},
+		},
+		{
+			name: "tag",
+			provider: s3Provider{
+				bucket:       "bucket",
+				prefix:       "inbox/",
+				deletePolicy: DeletePolicyTag,
+				client: &mockClient{
+					items: items(),
+				},
+			},
+			wantTags: map[string][]*s3.Tag{
+				"inbox/a": {
+					{Key: aws.String(deletedTagKey), Value: aws.String(deletedTagValue)},
+					{Key: aws.String("source"), Value: aws.String("ses")},
+				},
+				"inbox/b": {
+					{Key: aws.String(deletedTagKey), Value: aws.String(deletedTagValue)},
+				},
+			},
+		},
+		{
+			name: "storage class",
+			provider: s3Provider{
+				bucket:              "bucket",
+				prefix:              "inbox/",
+				deletePolicy:        DeletePolicyStorageClass,
+				archiveStorageClass: s3.StorageClassGlacier,
+				client: &mockClient{
+					items: items(),
+				},
+			},
+			wantCopies: []*s3.CopyObjectInput{
+				{Bucket: aws.String("bucket"), Key: aws.String("inbox/a"), CopySource: aws.String("bucket%2Finbox%2Fa"), StorageClass: aws.String(s3.StorageClassGlacier), MetadataDirective: aws.String(s3.MetadataDirectiveCopy)},
+				{Bucket: aws.String("bucket"), Key: aws.String("inbox/b"), CopySource: aws.String("bucket%2Finbox%2Fb"), StorageClass: aws.String(s3.StorageClassGlacier), MetadataDirective: aws.String(s3.MetadataDirectiveCopy)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			err := tt.provider.DeleteEmails([]int{1, 2})
+			mock := tt.provider.client.(*mockClient)
+			assert.EqualValues(t, tt.wantCopies, mock.copies)
+			assert.EqualValues(t, tt.wantTags, mock.putTags)
+			assert.EqualValues(t, tt.wantDelete, mock.deleteBatches)
+			var deleteErr *DeleteError
+			if errors.As(err, &deleteErr) {
+				assert.EqualValues(t, tt.wantIDs, deleteErr.IDs)
+			} else {
+				assert.NoError(t, err)
+				assert.Empty(t, tt.wantIDs)
+			}
 		})
 	}
 }
+
+func TestObjectCache(t *testing.T) {
+	t.Parallel()
+	cache := newObjectCache[bool](50 * time.Millisecond)
+	cache.add("a", true)
+	_, exists := cache.get("a")
+	assert.True(t, exists)
+	time.Sleep(60 * time.Millisecond)
+	_, exists = cache.get("a")
+	assert.False(t, exists)
+
+	// Buckets with the same name on different endpoints do not share entries.
+	minio := s3Provider{endpoint: "https://minio.example.com", bucket: "bucket"}
+	ceph := s3Provider{endpoint: "https://ceph.example.com", bucket: "bucket"}
+	assert.NotEqual(t, minio.cacheKey("a", "etag"), ceph.cacheKey("a", "etag"))
+}
+
+func TestInitCacheHidden(t *testing.T) {
+	t.Parallel()
+	provider := s3Provider{
+		bucket:       "bucket",
+		deletePolicy: DeletePolicyTag,
+		deleted:      newObjectCache[bool](0),
+		client: &mockClient{
+			items: []mockItem{
+				{key: "a", etag: "hidden-a", tags: map[string]string{deletedTagKey: deletedTagValue}},
+				{key: "b", etag: "hidden-b", tags: map[string]string{deletedTagKey: "false"}},
+				{key: "c", etag: "hidden-c"},
+			},
+		},
+	}
+	emails, err := provider.listEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, map[int]*Email{1: {ID: "b"}, 2: {ID: "c"}}, emails)
+	assert.EqualValues(t, 3, provider.client.(*mockClient).tagRequests)
+
+	// Deleted objects are cached while the others are requested again.
+	provider.cache = nil
+	_, err = provider.listEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 5, provider.client.(*mockClient).tagRequests)
+
+	// The tags of many objects are requested concurrently without changing the result.
+	var items []mockItem
+	want := make(map[int]*Email)
+	for index := 0; index < 100; index++ {
+		item := mockItem{key: fmt.Sprintf("many/%03d", index), etag: fmt.Sprintf("many-%v", index)}
+		if index%2 == 0 {
+			item.tags = map[string]string{deletedTagKey: deletedTagValue}
+		} else {
+			want[len(want)+1] = &Email{ID: item.key}
+		}
+		items = append(items, item)
+	}
+	provider = s3Provider{
+		bucket:       "bucket",
+		deletePolicy: DeletePolicyTag,
+		order:        OrderKey,
+		client:       &mockClient{items: items, pageSize: 30},
+	}
+	emails, err = provider.listEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, want, emails)
+	assert.EqualValues(t, 100, provider.client.(*mockClient).tagRequests)
+
+	provider = s3Provider{
+		bucket:              "bucket",
+		deletePolicy:        DeletePolicyStorageClass,
+		archiveStorageClass: s3.StorageClassGlacier,
+		client: &mockClient{
+			items: []mockItem{
+				{key: "a", storageClass: s3.StorageClassGlacier},
+				{key: "b", storageClass: s3.StorageClassStandard},
+			},
+		},
+	}
+	emails, err = provider.listEmails(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, map[int]*Email{1: {ID: "b"}}, emails)
+}
@@ -18,11 +18,14 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/markushinz/aws-ses-pop3-server/pkg/handler"
 )
@@ -34,7 +37,7 @@ type Server interface {
 	Close() error
 }
 
-func acceptConnections(handlerCreator handler.HandlerCreator, listener net.Listener) {
+func acceptConnections(handlerCreator handler.HandlerCreator, listener net.Listener, stlsConfig *tls.Config) {
 	log.Printf("Info: Listening on %v", listener.Addr().String())
 	for {
 		connection, err := listener.Accept()
@@ -44,43 +47,115 @@ func acceptConnections(handlerCreator handler.HandlerCreator, listener net.Liste
 			}
 			fmt.Printf("Error: acceptConnections(): %v", err)
 		} else {
-			go handleConnection(handlerCreator, connection)
+			go handleConnection(handlerCreator, connection, stlsConfig)
 		}
 	}
 }
 
-func handleConnection(handlerCreator handler.HandlerCreator, connection net.Conn) {
+func getTLSState(connection net.Conn, stlsConfig *tls.Config) handler.TLSState {
+	if _, ok := connection.(*tls.Conn); ok {
+		return handler.TLSActive
+	}
+	if stlsConfig != nil {
+		return handler.TLSAvailable
+	}
+	return handler.TLSUnavailable
+}
+
+func handleConnection(handlerCreator handler.HandlerCreator, connection net.Conn, stlsConfig *tls.Config) {
 	log.Printf("Info: %v connected", connection.RemoteAddr().String())
-	handler, response, err := handlerCreator()
+	connectionHandler, response, err := handlerCreator(getTLSState(connection, stlsConfig))
 	if err != nil {
 		log.Fatal(fmt.Sprintf("Fatal error: handleConnection(): %v", err))
 	}
-	connection.Write([]byte(response + "\r\n"))
+	// The reader and the writer are kept for the lifetime of the connection as clients may pipeline commands.
+	// Responses are buffered until all pipelined commands have been handled.
+	// Source: https://www.ietf.org/rfc/rfc2449.txt
+	reader := bufio.NewReader(connection)
+	deadlineConnection := &deadlineWriter{connection: connection}
+	writer := bufio.NewWriter(deadlineConnection)
+	writer.WriteString(response + "\r\n")
+	_, deadlineConnection.timeout = connectionHandler.Timeouts()
+	if err := writer.Flush(); err != nil {
+		closeConnection(connectionHandler, connection)
+		return
+	}
 	for {
-		bytes, err := bufio.NewReader(connection).ReadBytes('\n')
+		var readTimeout time.Duration
+		readTimeout, deadlineConnection.timeout = connectionHandler.Timeouts()
+		connection.SetReadDeadline(deadline(readTimeout))
+		bytes, err := reader.ReadBytes('\n')
 		if err != nil {
-			closeConnection(handler, connection)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				// The autologout timer expired: close the connection without entering the UPDATE state or sending any response.
+				// Source: https://www.ietf.org/rfc/rfc1939.txt
+				log.Printf("Info: %v autologout after %v of inactivity", connection.RemoteAddr().String(), readTimeout)
+			}
+			closeConnection(connectionHandler, connection)
 			return
 		}
 		message := strings.TrimRight(string(bytes), "\r\n")
-		responses, quit := handler.Handle(message)
-		for i, response := range responses {
-			// If any line of the multi-line response begins with the termination octet,
-			// the line is "byte-stuffed" by pre-pending the termination octet to that line of the response.
-			// Source: https://www.ietf.org/rfc/rfc1939.txt
-			if strings.HasPrefix(response, ".") && i < len(responses)-1 {
-				response = "." + response
+		action, err := connectionHandler.Handle(message, writer)
+		if err != nil {
+			log.Printf("Error: handleConnection(): %v", err)
+			closeConnection(connectionHandler, connection)
+			return
+		}
+		if reader.Buffered() == 0 || action != handler.ActionNone {
+			if err := writer.Flush(); err != nil {
+				log.Printf("Error: handleConnection(): %v", err)
+				closeConnection(connectionHandler, connection)
+				return
 			}
-			connection.Write([]byte(response + "\r\n"))
 		}
-		if quit {
-			closeConnection(handler, connection)
+		switch action {
+		case handler.ActionQuit:
+			closeConnection(connectionHandler, connection)
 			return
+		case handler.ActionSTLS:
+			// Commands pipelined after STLS were sent in plaintext and must not be executed after the negotiation.
+			// Source: https://www.ietf.org/rfc/rfc2595.txt
+			if reader.Buffered() > 0 {
+				log.Printf("Error: handleConnection(): discarding %v bytes pipelined after STLS", reader.Buffered())
+				reader.Discard(reader.Buffered())
+			}
+			tlsConnection := tls.Server(connection, stlsConfig)
+			readTimeout, _ := connectionHandler.Timeouts()
+			connection.SetDeadline(deadline(readTimeout))
+			if err := tlsConnection.Handshake(); err != nil {
+				log.Printf("Error: handleConnection(): %v", err)
+				closeConnection(connectionHandler, connection)
+				return
+			}
+			connection = tlsConnection
+			reader = bufio.NewReader(connection)
+			deadlineConnection = &deadlineWriter{connection: connection}
+			writer = bufio.NewWriter(deadlineConnection)
 		}
 	}
 }
 
-func closeConnection(handler handler.Handler, connection net.Conn) {
+// deadlineWriter renews the write deadline before every write so that large responses
+// only fail if the client stops reading.
+type deadlineWriter struct {
+	connection net.Conn
+	timeout    time.Duration
+}
+
+func (writer *deadlineWriter) Write(b []byte) (n int, err error) {
+	writer.connection.SetWriteDeadline(deadline(writer.timeout))
+	return writer.connection.Write(b)
+}
+
+// deadline returns the deadline for timeout or the zero time (no deadline) if timeout is zero.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+func closeConnection(connectionHandler handler.Handler, connection net.Conn) {
 	log.Printf("Info: %v disconnected", connection.RemoteAddr().String())
 	connection.Close()
 }
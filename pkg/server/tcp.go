@@ -49,7 +49,7 @@ func newTCPServer(handlerCreator handler.HandlerCreator, host string, port int)
 }
 
 func (server *tcpServer) Listen() {
-	acceptConnections(server.handlerCreator, server.listener)
+	acceptConnections(server.handlerCreator, server.listener, nil)
 }
 
 func (server *tcpServer) Close() error {
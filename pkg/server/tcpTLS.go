@@ -51,7 +51,7 @@ func newTCPTLSServer(handlerCreator handler.HandlerCreator, host string, port in
 }
 
 func (server *tcpTLSServer) Listen() {
-	acceptConnections(server.handlerCreator, server.listener)
+	acceptConnections(server.handlerCreator, server.listener, nil)
 }
 
 func (server *tcpTLSServer) Close() error {